@@ -4,7 +4,7 @@
 --
 -- For a single UUID, there may be multiple Timestamps per day in tcpinfo due to
 -- some long lived connections (probably not actual NDT measurements). The
--- export query groups on the UUID and year_month_day to guarantee a single
+-- export query groups on the UUID and the date to guarantee a single
 -- UUID per day. The query uses any Server and Client annotation from that day
 -- and the first (minimum) Timestamp.
 --
@@ -36,7 +36,11 @@ SELECT
     MIN(tcpinfo.TestTime) AS Timestamp,
     ANY_VALUE(tcpinfo.ServerX) AS Server,
     ANY_VALUE(tcpinfo.ClientX) AS Client,
-    REPLACE(CAST(DATE(tcpinfo.TestTime) AS STRING), "-", "/") AS year_month_day,
+    -- The date is returned as separate year, month and day fields, since
+    -- output path values must not contain "/".
+    FORMAT_DATE("%Y", DATE(tcpinfo.TestTime)) AS year,
+    FORMAT_DATE("%m", DATE(tcpinfo.TestTime)) AS month,
+    FORMAT_DATE("%d", DATE(tcpinfo.TestTime)) AS day,
 FROM
     tcpinfos AS tcpinfo
 LEFT OUTER JOIN
@@ -52,4 +56,6 @@ WHERE
     AND tcpinfo.ServerX.Geo IS NOT NULL
 GROUP BY
     UUID,
-    year_month_day
+    year,
+    month,
+    day
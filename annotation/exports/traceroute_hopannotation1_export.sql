@@ -21,7 +21,10 @@ SELECT
     FORMAT_TIMESTAMP("%FT%TZ", MIN(hop.Source.hopannotation1.Timestamp)) AS Timestamp,
     ANY_VALUE(hop.Source.hopannotation1.Annotations) AS Annotations,
 -- The below fields are used to construct the file path and name.
-    REPLACE(CAST(DATE(hop.Source.hopannotation1.Timestamp) AS STRING), "-", "/") AS Date,
+-- Output path values must not contain "/", so the date is split in Year, Month and Day.
+    FORMAT_DATE("%Y", DATE(hop.Source.hopannotation1.Timestamp)) AS Year,
+    FORMAT_DATE("%m", DATE(hop.Source.hopannotation1.Timestamp)) AS Month,
+    FORMAT_DATE("%d", DATE(hop.Source.hopannotation1.Timestamp)) AS Day,
     FORMAT_TIMESTAMP("%Y%m%dT000000Z", MIN(hop.Source.hopannotation1.Timestamp)) AS FilenameTimestamp,
     REGEXP_EXTRACT(hop.Source.hopannotation1.ID, r".+_(.+)_.+") AS Hostname,
     ANY_VALUE(hop.Source.IP) AS IP
@@ -35,4 +38,4 @@ WHERE annotation.id IS NULL
     AND hop.Source.hopannotation1.ID != ""
     AND hop.Source.hopannotation1.ID IS NOT NULL
     AND hop.Source.hopannotation1.Annotations IS NOT NULL
-GROUP BY hop.Source.hopannotation1.ID, Date
+GROUP BY hop.Source.hopannotation1.ID, Year, Month, Day
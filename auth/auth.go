@@ -0,0 +1,199 @@
+// Package auth provides an optional authentication middleware for the
+// pipeline's HTTP endpoints.
+//
+// Requests must have an "Authorization: Bearer <token>" header whose token is
+// either one of the static tokens configured with -auth.tokens (or the
+// AUTH_TOKENS environment variable) and -auth.tokens-file, or a Google-signed
+// OIDC ID token whose audience is -auth.audience. If -auth.allowed-emails is
+// set, ID tokens must also have one of these verified emails. Requests are
+// not authenticated if none of these flags is set.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+var (
+	tokens        flagx.StringArray
+	tokensFile    = flagx.File{}
+	audience      = flag.String("auth.audience", "", "Audience of the accepted Google-signed OIDC ID tokens")
+	allowedEmails flagx.StringArray
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_auth_requests_total",
+		Help: "Requests checked by the authentication middleware",
+	}, []string{
+		"result",
+	})
+)
+
+// Issuers of Google-signed ID tokens.
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+func init() {
+	flag.Var(&tokens, "auth.tokens",
+		"Accepted static bearer tokens, comma-separated")
+	flag.Var(&tokensFile, "auth.tokens-file",
+		"File of accepted static bearer tokens, one per line")
+	flag.Var(&allowedEmails, "auth.allowed-emails",
+		"Emails allowed to authenticate with an ID token, comma-separated (default: any)")
+}
+
+// TokenValidator validates OIDC ID tokens. It is implemented by
+// *idtoken.Validator.
+type TokenValidator interface {
+	Validate(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+}
+
+// Authenticator checks the bearer token of HTTP requests.
+type Authenticator struct {
+	// tokens are the SHA-256 hashes of the static tokens, so that they can
+	// be compared in constant time.
+	tokens [][]byte
+	// validator validates the ID tokens if an audience is configured.
+	validator TokenValidator
+	audience  string
+	emails    map[string]bool
+}
+
+// New returns an Authenticator configured with the -auth.* flags. The options
+// configure the HTTP client used to fetch Google's public keys.
+func New(ctx context.Context, opts ...option.ClientOption) (*Authenticator, error) {
+	a := &Authenticator{
+		audience: *audience,
+		emails:   map[string]bool{},
+	}
+	for _, t := range tokens {
+		a.addToken(t)
+	}
+	s := bufio.NewScanner(bytes.NewReader(tokensFile.Get()))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a.addToken(line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read the tokens file: %v", err)
+	}
+	for _, e := range allowedEmails {
+		if e = strings.TrimSpace(e); e != "" {
+			a.emails[e] = true
+		}
+	}
+	if len(a.emails) > 0 && a.audience == "" {
+		return nil, errors.New("-auth.allowed-emails requires -auth.audience")
+	}
+	if a.audience != "" {
+		v, err := idtoken.NewValidator(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		a.validator = v
+	}
+	return a, nil
+}
+
+func (a *Authenticator) addToken(t string) {
+	if t = strings.TrimSpace(t); t != "" {
+		h := sha256.Sum256([]byte(t))
+		a.tokens = append(a.tokens, h[:])
+	}
+}
+
+// Enabled returns whether requests must be authenticated.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || a.validator != nil
+}
+
+// Wrap returns a handler serving the authenticated requests with h, and
+// rejecting the other ones with 401 Unauthorized, or 403 Forbidden if an ID
+// token's email isn't allowed. It returns h if authentication isn't enabled.
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, status, err := a.authenticate(r)
+		if err != nil {
+			result := "unauthorized"
+			if status == http.StatusForbidden {
+				result = "forbidden"
+			}
+			requestsTotal.WithLabelValues(result).Inc()
+			slog.WarnContext(r.Context(), "rejected request",
+				"path", r.URL.Path, "remote_addr", r.RemoteAddr,
+				"status", status, "error", err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		requestsTotal.WithLabelValues("allowed").Inc()
+		slog.InfoContext(r.Context(), "authenticated request",
+			"path", r.URL.Path, "principal", principal)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the principal making the request, or the HTTP status
+// and error to reply with if it isn't authenticated or allowed.
+func (a *Authenticator) authenticate(r *http.Request) (string, int, error) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", http.StatusUnauthorized, errors.New("missing bearer token")
+	}
+	token = strings.TrimSpace(token)
+	h := sha256.Sum256([]byte(token))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(h[:], t) == 1 {
+			return "static-token", 0, nil
+		}
+	}
+	if a.validator == nil {
+		return "", http.StatusUnauthorized, errors.New("invalid token")
+	}
+	payload, err := a.validator.Validate(r.Context(), token, a.audience)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	if !googleIssuers[payload.Issuer] {
+		return "", http.StatusUnauthorized,
+			fmt.Errorf("invalid issuer: %q", payload.Issuer)
+	}
+	email, _ := payload.Claims["email"].(string)
+	if len(a.emails) == 0 {
+		if email == "" {
+			return payload.Subject, 0, nil
+		}
+		return email, 0, nil
+	}
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified ||
+		!a.emails[email] {
+		return "", http.StatusForbidden,
+			fmt.Errorf("email not allowed: %q", email)
+	}
+	return email, 0, nil
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/go/rtx"
+	"google.golang.org/api/option"
+)
+
+// jwksTransport serves the public key of a locally generated key pair in
+// place of Google's certificates.
+type jwksTransport struct {
+	kid string
+	key *rsa.PublicKey
+}
+
+func (t *jwksTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"alg": "RS256",
+			"kid": t.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(t.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(t.key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// signToken returns an ID token with the given claims, signed with key.
+func signToken(t *testing.T, kid string, key *rsa.PrivateKey,
+	claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": kid,
+	})
+	rtx.Must(err, "cannot marshal header")
+	payload, err := json.Marshal(claims)
+	rtx.Must(err, "cannot marshal claims")
+	content := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	rtx.Must(err, "cannot sign token")
+	return content + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// setFlags sets the -auth.* flags for the duration of a test.
+func setFlags(t *testing.T, tok []string, file string, aud string,
+	emails []string) {
+	oldTokens, oldFile, oldAudience, oldEmails := tokens, tokensFile,
+		*audience, allowedEmails
+	t.Cleanup(func() {
+		tokens, tokensFile, *audience, allowedEmails = oldTokens, oldFile,
+			oldAudience, oldEmails
+	})
+	tokens, *audience, allowedEmails = tok, aud, emails
+	tokensFile = flagx.File{}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "tokens")
+		rtx.Must(os.WriteFile(path, []byte(file), 0600),
+			"cannot write tokens file")
+		rtx.Must(tokensFile.Set(path), "cannot read tokens file")
+	}
+}
+
+func TestAuthenticator_Wrap(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	rtx.Must(err, "cannot generate key")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	rtx.Must(err, "cannot generate key")
+	setFlags(t, []string{"secret"}, "# comment\n\nfile-secret\n", "test-aud",
+		[]string{"allowed@example.com"})
+	a, err := New(context.Background(), option.WithHTTPClient(&http.Client{
+		Transport: &jwksTransport{kid: "key", key: &key.PublicKey},
+	}))
+	rtx.Must(err, "cannot create Authenticator")
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            "test-aud",
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+			"sub":            "1234",
+			"email":          "allowed@example.com",
+			"email_verified": true,
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{
+			name: "no-header",
+			want: http.StatusUnauthorized,
+		},
+		{
+			name:   "not-bearer",
+			header: "Basic secret",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "static-token",
+			header: "Bearer secret",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "file-token",
+			header: "bearer file-secret",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "invalid-token",
+			header: "Bearer not-a-secret",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "id-token",
+			header: "Bearer " + signToken(t, "key", key, claims(nil)),
+			want:   http.StatusOK,
+		},
+		{
+			name: "id-token-wrong-audience",
+			header: "Bearer " + signToken(t, "key", key, claims(
+				map[string]interface{}{"aud": "other-aud"})),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "id-token-expired",
+			header: "Bearer " + signToken(t, "key", key, claims(
+				map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "id-token-wrong-issuer",
+			header: "Bearer " + signToken(t, "key", key, claims(
+				map[string]interface{}{"iss": "https://example.com"})),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name:   "id-token-wrong-key",
+			header: "Bearer " + signToken(t, "key", otherKey, claims(nil)),
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name: "id-token-email-not-allowed",
+			header: "Bearer " + signToken(t, "key", key, claims(
+				map[string]interface{}{"email": "other@example.com"})),
+			want: http.StatusForbidden,
+		},
+		{
+			name: "id-token-email-not-verified",
+			header: "Bearer " + signToken(t, "key", key, claims(
+				map[string]interface{}{"email_verified": false})),
+			want: http.StatusForbidden,
+		},
+	}
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v0/pipeline", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("Wrap() returned status %d, want %d", rec.Code,
+					tt.want)
+			}
+			if tt.want == http.StatusUnauthorized &&
+				rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("Wrap() didn't ask for a bearer token")
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokens      []string
+		file        string
+		audience    string
+		emails      []string
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:        "tokens",
+			tokens:      []string{"a", " "},
+			wantEnabled: true,
+		},
+		{
+			name:        "tokens-file",
+			file:        "a\nb\n",
+			wantEnabled: true,
+		},
+		{
+			name:        "audience",
+			audience:    "aud",
+			wantEnabled: true,
+		},
+		{
+			name:    "emails-without-audience",
+			emails:  []string{"a@example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.tokens, tt.file, tt.audience, tt.emails)
+			a, err := New(context.Background(),
+				option.WithHTTPClient(http.DefaultClient))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if a.Enabled() != tt.wantEnabled {
+				t.Errorf("Enabled() = %v, want %v", a.Enabled(),
+					tt.wantEnabled)
+			}
+			h := http.NewServeMux()
+			if wrapped := a.Wrap(h); (wrapped == h) == tt.wantEnabled {
+				t.Errorf("Wrap() wrapped the handler: %v, want %v",
+					wrapped != h, tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	requestsTotal.WithLabelValues("x")
+
+	promtest.LintMetrics(t)
+}
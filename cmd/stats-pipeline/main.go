@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"runtime"
 
 	"cloud.google.com/go/bigquery"
@@ -17,12 +19,15 @@ import (
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
-	"github.com/m-lab/go/uploader"
+	"github.com/m-lab/stats-pipeline/auth"
 	"github.com/m-lab/stats-pipeline/config"
 	"github.com/m-lab/stats-pipeline/exporter"
 	"github.com/m-lab/stats-pipeline/formatter"
+	"github.com/m-lab/stats-pipeline/logging"
 	"github.com/m-lab/stats-pipeline/output"
 	"github.com/m-lab/stats-pipeline/pipeline"
+	"github.com/m-lab/stats-pipeline/tiles"
+	"github.com/m-lab/stats-pipeline/tracing"
 )
 
 const dateFormat = "2006-01-02"
@@ -36,8 +41,8 @@ var (
 		Value:   "gcs",
 	}
 	exportType = flagx.Enum{
-		Options: []string{"stats", "annotation", "hopannotation1"},
-		Value:   "stats",
+		Options: formatter.Names(),
+		Value:   formatter.Default,
 	}
 
 	configFile = flagx.File{}
@@ -52,7 +57,8 @@ func init() {
 		"GCS bucket to export the result to")
 	flag.Var(&configFile, "config", "JSON configuration file")
 	flag.Var(&outputType, "output", "Output to gcs or local files.")
-	flag.Var(&exportType, "export", "Generate and export the named data type.")
+	flag.Var(&exportType, "export",
+		"Generate and export the named data type for configs without a formatter.")
 }
 
 func makeHTTPServer(listenAddr string, h http.Handler) *http.Server {
@@ -64,48 +70,81 @@ func makeHTTPServer(listenAddr string, h http.Handler) *http.Server {
 
 func main() {
 	flag.Parse()
-	log.SetFlags(log.LUTC | log.Lshortfile | log.LstdFlags)
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env args")
+	rtx.Must(logging.Setup(os.Stderr), "Could not configure logging")
 
 	// Try parsing provided config file.
 	var configs map[string]config.Config
 	err := json.Unmarshal(configFile.Get(), &configs)
 	rtx.Must(err, "cannot parse configuration file")
+	rtx.Must(pipeline.CheckDependencies(configs), "invalid configuration file")
+
+	// Export the trace spans as configured with -tracing.exporter.
+	shutdownTracing, err := tracing.Setup(mainCtx, "stats-pipeline")
+	rtx.Must(err, "error initializing tracing")
+	defer shutdownTracing(mainCtx)
 
 	bqClient, err := bigquery.NewClient(mainCtx, project)
 	rtx.Must(err, "error initializing BQ client")
 
+	rtx.Must(exporter.EnableStorageRead(mainCtx, bqClient),
+		"error initializing BQ Storage Read API client")
+
 	gcsClient, err := storage.NewClient(mainCtx)
 	rtx.Must(err, "error initializing GCS client")
 
 	var wr exporter.Writer
 	switch outputType.Value {
 	case "gcs":
-		wr = output.NewGCSWriter(uploader.New(stiface.AdaptClient(gcsClient), bucket))
+		wr = output.NewGCSWriter(stiface.AdaptClient(gcsClient), bucket)
 	case "local":
 		wr = output.NewLocalWriter(bucket)
 	}
 
-	var f exporter.Formatter
-	switch exportType.Value {
-	case "stats":
-		f = formatter.NewStatsQueryFormatter()
-	case "annotation":
-		f = formatter.NewTCPINFOAnnotationQueryFormatter()
-	case "hopannotation1":
-		f = formatter.NewTracerouteHopAnnotation1QueryFormatter()
+	// Create an exporter for each config, using the config's formatter or
+	// the one selected on the command line. EXPORT DATA stages its files in
+	// the GCS bucket even when the output is local.
+	exporters := map[string]pipeline.Exporter{}
+	for name, c := range configs {
+		formatterName := c.Formatter
+		if formatterName == "" {
+			formatterName = exportType.Value
+		}
+		f, err := formatter.New(formatterName, c)
+		rtx.Must(err, "invalid formatter for config %s", name)
+		switch c.Exporter {
+		case "", "json":
+			exporters[name] = exporter.New(bqiface.AdaptClient(bqClient),
+				project, wr, f)
+		case "export-data":
+			exporters[name] = exporter.NewExportData(
+				bqiface.AdaptClient(bqClient), project,
+				stiface.AdaptClient(gcsClient), bucket, wr, f)
+		default:
+			log.Fatalf("invalid exporter for config %s: %q", name, c.Exporter)
+		}
 	}
-	exp := exporter.New(bqiface.AdaptClient(bqClient), project, wr, f)
+	mt := tiles.New(bqiface.AdaptClient(bqClient), project, wr)
 
 	// Initialize handlers.
 	pipelineHandler := pipeline.NewHandler(bqiface.AdaptClient(bqClient),
-		exp, configs)
+		exporters, mt, configs)
+
+	// Require authentication if configured with the -auth.* flags.
+	authenticator, err := auth.New(mainCtx)
+	rtx.Must(err, "error initializing authentication")
+	if !authenticator.Enabled() {
+		slog.WarnContext(mainCtx, "/v0/pipeline accepts unauthenticated requests")
+	}
 
 	// Initialize mux.
 	mux := http.NewServeMux()
-	mux.Handle("/v0/pipeline", pipelineHandler)
+	mux.Handle("/v0/pipeline", authenticator.Wrap(pipelineHandler))
+	runsHandler := authenticator.Wrap(pipelineHandler.Runs())
+	mux.Handle("/v0/pipeline/runs", runsHandler)
+	mux.Handle("/v0/pipeline/runs/", runsHandler)
 
-	log.Printf("GOMAXPROCS is %d", runtime.GOMAXPROCS(0))
+	slog.InfoContext(mainCtx, "starting", "gomaxprocs", runtime.GOMAXPROCS(0))
 
 	// Start main HTTP server.
 	s := makeHTTPServer(listenAddr, mux)
@@ -33,7 +33,96 @@ type Config struct {
 	// Table is the histogram table name. This field is required.
 	Table string
 
+	// Formatter is the name of the formatter used to export this config's
+	// data, e.g. "stats", "annotation" or "hopannotation1". If empty, the
+	// formatter selected on the command line is used.
+	// This field is optional.
+	Formatter string
+
+	// Exporter selects how this config's files are exported. Possible
+	// values are:
+	//   - "json": run the export query and write the files from its rows
+	//     (default)
+	//   - "export-data": let BigQuery write the rows of each partition with
+	//     EXPORT DATA, then convert and rename the staged files. Every
+	//     partition's rows must map to a single output path.
+	// This field is optional.
+	Exporter string
+
+	// PartitionDateExpr is the BigQuery expression used to extract a row's
+	// date when listing the partitions of typed formatters (e.g.
+	// "annotation"). If empty, the schema's default expression is used.
+	// This field is optional.
+	PartitionDateExpr string
+
 	// OutputPath is a template defining the output path - either local or GCS.
+	// Its parameters are the export query's fields, which can be transformed
+	// with the lower, upper, pad, escape and replace functions, e.g.
+	// "{{ .city | lower | escape }}/{{ .asn | pad 6 }}.json", and the
+	// exported period (see Period).
 	// This field is required.
 	OutputPath string
+
+	// OutputCollisions selects what happens when different files exported
+	// for this config map to the same output path. Possible values are:
+	//   - "report": log and count the collision, the later file overwrites
+	//     the earlier one (default)
+	//   - "fail": log and count the collision, keep the earlier file and
+	//     fail the export
+	//   - "merge": upload a single file with the rows of all the colliding
+	//     files, once the whole export has been queried
+	// This field is optional.
+	OutputCollisions string
+
+	// Period is the time span covered by each histogram table and each
+	// export run. Possible values are:
+	//   - "yearly": one table per year, e.g. table_2020 (default)
+	//   - "quarterly": one table per quarter, e.g. table_2020_q1
+	//   - "monthly": one table per month, e.g. table_2020_01
+	// The export query and OutputPath can use the exported period as
+	// {{ .period }} (the table suffix, e.g. "2020_01"), {{ .periodStart }}
+	// and {{ .periodEnd }} (YYYY-MM-DD). With a period shorter than a year,
+	// OutputPath must use {{ .period }}, or each export will overwrite the
+	// files of the previous periods of the same year.
+	// This field is optional.
+	Period string
+
+	// Granularity is the time span aggregated by each row of the histogram
+	// table. Possible values are:
+	//   - "daily": one row per day (default)
+	//   - "weekly": one row per ISO week, dated on its Monday
+	//   - "monthly": one row per month, dated on its first day
+	//   - "yearly": one row per year, dated on January 1st
+	// Rollups are computed from the same daily samples as daily histograms.
+	// The histogram query must use {{ .rollupDate }} as the date of the
+	// sampled rows. Updating any day recomputes its whole rollup, e.g. the
+	// whole year for yearly rollups (see README.md for the cost).
+	// This field is optional.
+	Granularity string
+
+	// ExportStartDate and ExportEndDate (YYYY-MM-DD) bound the dates
+	// exported for this config. The dates requested from the pipeline are
+	// clipped to these bounds, and nothing is exported if they do not
+	// overlap. Formatters listing partitions by date only list the partitions
+	// within the resulting range.
+	// These fields are optional.
+	ExportStartDate string
+	ExportEndDate   string
+
+	// MaptilesQueryFile is the path to the query generating the per-year
+	// aggregates used to build the map tiles. Configs without it are skipped
+	// by the maptiles step.
+	// This field is optional.
+	MaptilesQueryFile string
+
+	// MaptilesOutputPath is a template defining the output path of the
+	// per-year map tiles aggregates. Its only parameter is {{ .year }}.
+	// This field is required if MaptilesQueryFile is set.
+	MaptilesOutputPath string
+
+	// DependsOn is the list of configs (by name) whose histogram tables must
+	// be updated before this config's. If updating any of them fails, this
+	// config's histogram table is not updated.
+	// This field is optional.
+	DependsOn []string
 }
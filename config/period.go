@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Possible values for Config.Period.
+const (
+	// Yearly means one histogram table and one set of exported files per
+	// calendar year. This is the default.
+	Yearly = "yearly"
+
+	// Quarterly means one histogram table and one set of exported files per
+	// calendar quarter.
+	Quarterly = "quarterly"
+
+	// Monthly means one histogram table and one set of exported files per
+	// calendar month.
+	Monthly = "monthly"
+)
+
+// Possible values for Config.Granularity, in addition to Monthly and Yearly.
+const (
+	// Daily means one histogram row per day. This is the default.
+	Daily = "daily"
+
+	// Weekly means one histogram row per ISO week.
+	Weekly = "weekly"
+)
+
+// Period is a range of dates falling within a single yearly, quarterly or
+// monthly period.
+type Period struct {
+	// Granularity is one of Yearly, Quarterly or Monthly.
+	Granularity string
+
+	// Start is the first date in the range.
+	Start time.Time
+
+	// End is the last date in the range, included.
+	End time.Time
+}
+
+// PeriodOf returns the full Period with the given granularity containing t.
+// An empty granularity is the same as Yearly.
+func PeriodOf(t time.Time, granularity string) (Period, error) {
+	var start, end time.Time
+	switch granularity {
+	case "", Yearly:
+		granularity = Yearly
+		start = time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(1, 0, -1)
+	case Quarterly:
+		month := time.Month((int(t.Month())-1)/3*3 + 1)
+		start = time.Date(t.Year(), month, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 3, -1)
+	case Monthly:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, -1)
+	default:
+		return Period{}, fmt.Errorf("invalid period: %q", granularity)
+	}
+	return Period{
+		Granularity: granularity,
+		Start:       start,
+		End:         end,
+	}, nil
+}
+
+// Year returns the year this period belongs to.
+func (p Period) Year() int {
+	return p.Start.Year()
+}
+
+// Suffix returns the suffix appended to histogram table names for this
+// period, e.g. "2020" (yearly), "2020_q1" (quarterly) or "2020_01" (monthly).
+func (p Period) Suffix() string {
+	switch p.Granularity {
+	case Quarterly:
+		return fmt.Sprintf("%d_q%d", p.Start.Year(), (int(p.Start.Month())-1)/3+1)
+	case Monthly:
+		return fmt.Sprintf("%d_%02d", p.Start.Year(), int(p.Start.Month()))
+	default:
+		return fmt.Sprintf("%d", p.Start.Year())
+	}
+}
+
+// RollupOf returns the first and last dates of the rollup with the given
+// granularity containing t. An empty granularity is the same as Daily.
+func RollupOf(t time.Time, granularity string) (time.Time, time.Time, error) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch granularity {
+	case "", Daily:
+		return day, day, nil
+	case Weekly:
+		// ISO weeks start on Monday.
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 6), nil
+	case Monthly, Yearly:
+		p, err := PeriodOf(day, granularity)
+		return p.Start, p.End, err
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid granularity: %q",
+			granularity)
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		t           time.Time
+		granularity string
+		wantStart   time.Time
+		wantEnd     time.Time
+		wantSuffix  string
+		wantErr     bool
+	}{
+		{
+			name:       "default-yearly",
+			t:          time.Date(2020, time.May, 12, 0, 0, 0, 0, time.UTC),
+			wantStart:  time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:    time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+			wantSuffix: "2020",
+		},
+		{
+			name:        "quarterly",
+			t:           time.Date(2020, time.May, 12, 0, 0, 0, 0, time.UTC),
+			granularity: Quarterly,
+			wantStart:   time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2020, time.June, 30, 0, 0, 0, 0, time.UTC),
+			wantSuffix:  "2020_q2",
+		},
+		{
+			name:        "monthly",
+			t:           time.Date(2020, time.February, 12, 0, 0, 0, 0, time.UTC),
+			granularity: Monthly,
+			wantStart:   time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+			wantSuffix:  "2020_02",
+		},
+		{
+			name:        "invalid",
+			t:           time.Date(2020, time.February, 12, 0, 0, 0, 0, time.UTC),
+			granularity: "daily",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PeriodOf(tt.t, tt.granularity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PeriodOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !got.Start.Equal(tt.wantStart) || !got.End.Equal(tt.wantEnd) {
+				t.Errorf("PeriodOf() = %v - %v, want %v - %v", got.Start,
+					got.End, tt.wantStart, tt.wantEnd)
+			}
+			if got.Suffix() != tt.wantSuffix {
+				t.Errorf("Period.Suffix() = %v, want %v", got.Suffix(), tt.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestRollupOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		t           time.Time
+		granularity string
+		wantStart   time.Time
+		wantEnd     time.Time
+		wantErr     bool
+	}{
+		{
+			name:      "default-daily",
+			t:         time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "weekly-iso",
+			t:           time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC),
+			granularity: Weekly,
+			wantStart:   time.Date(2020, time.December, 28, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "weekly-monday",
+			t:           time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC),
+			granularity: Weekly,
+			wantStart:   time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2021, time.January, 10, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "monthly",
+			t:           time.Date(2021, time.February, 10, 0, 0, 0, 0, time.UTC),
+			granularity: Monthly,
+			wantStart:   time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2021, time.February, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "yearly",
+			t:           time.Date(2021, time.February, 10, 0, 0, 0, 0, time.UTC),
+			granularity: Yearly,
+			wantStart:   time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:     time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "invalid",
+			t:           time.Date(2021, time.February, 10, 0, 0, 0, 0, time.UTC),
+			granularity: Quarterly,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := RollupOf(tt.t, tt.granularity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RollupOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("RollupOf() = %v - %v, want %v - %v", start, end,
+					tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
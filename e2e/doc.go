@@ -0,0 +1,15 @@
+// Package e2e contains end-to-end tests running the whole stats pipeline, i.e.
+// the real histogram and export queries, pipeline.Handler, histogram.Table and
+// the JSONExporter, against a local BigQuery emulator loaded with small
+// fixture datasets. Each test case runs the pipeline for a config file in
+// testdata, and its exported files are compared with the golden files under
+// testdata/golden/<test case>.
+//
+// The tests require the integration build tag and a running emulator:
+//
+//	docker compose -f compose-e2e.yaml up -d
+//	BIGQUERY_EMULATOR_HOST=http://localhost:9050 go test -tags integration ./e2e
+//
+// After changing a query or the exporter, run the tests with -update to
+// regenerate the golden files and review the diff.
+package e2e
@@ -0,0 +1,173 @@
+//go:build integration
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/exporter"
+	"github.com/m-lab/stats-pipeline/formatter"
+	"github.com/m-lab/stats-pipeline/output"
+	"github.com/m-lab/stats-pipeline/pipeline"
+	"github.com/m-lab/stats-pipeline/tiles"
+	"google.golang.org/api/option"
+)
+
+// The emulator's project, as configured in testdata/fixtures.yaml.
+const project = "test"
+
+var (
+	emulatorHost = flag.String("emulator", os.Getenv("BIGQUERY_EMULATOR_HOST"),
+		"URL of the BigQuery emulator, e.g. http://localhost:9050")
+	update = flag.Bool("update", false, "update the golden files")
+)
+
+// newClient returns a BigQuery client for the emulator, or skips the test if
+// no emulator has been provided.
+func newClient(t *testing.T) bqiface.Client {
+	if *emulatorHost == "" {
+		t.Skip("BIGQUERY_EMULATOR_HOST is not set, see compose-e2e.yaml")
+	}
+	client, err := bigquery.NewClient(context.Background(), project,
+		option.WithEndpoint(*emulatorHost+"/bigquery/v2/"),
+		option.WithoutAuthentication())
+	rtx.Must(err, "cannot create BigQuery client")
+	t.Cleanup(func() { client.Close() })
+	return bqiface.AdaptClient(client)
+}
+
+// loadConfigs reads a configuration file from testdata.
+func loadConfigs(t *testing.T, name string) map[string]config.Config {
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	rtx.Must(err, "cannot read %s", name)
+	var configs map[string]config.Config
+	rtx.Must(json.Unmarshal(content, &configs), "cannot parse %s", name)
+	rtx.Must(pipeline.CheckDependencies(configs), "invalid %s", name)
+	return configs
+}
+
+// readTree returns the content of every file under dir, by relative path.
+func readTree(t *testing.T, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	rtx.Must(err, "cannot read %s", dir)
+	return files
+}
+
+// checkGolden compares the files under dir with the golden directory, or
+// replaces the golden directory with them if the -update flag is set.
+func checkGolden(t *testing.T, dir, golden string) {
+	got := readTree(t, dir)
+	if *update {
+		rtx.Must(os.RemoveAll(golden), "cannot remove golden files")
+		for name, content := range got {
+			path := filepath.Join(golden, filepath.FromSlash(name))
+			rtx.Must(os.MkdirAll(filepath.Dir(path), 0775),
+				"cannot create golden directory")
+			rtx.Must(os.WriteFile(path, []byte(content), 0664),
+				"cannot write golden file")
+		}
+	}
+	want := readTree(t, golden)
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s does not match the golden file, run go test with "+
+				"-update and review the diff", name)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected file %s, run go test with -update and "+
+				"review the diff", name)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		query  string
+	}{
+		{
+			// The global config and the countries config, sharded by
+			// country, from their histograms to their exported files.
+			name:   "statistics",
+			config: "config.json",
+			query:  "start=2020-01-01&end=2020-01-02&step=all",
+		},
+		{
+			// Annotation configs have no histogram query, so only the
+			// exports step is run, as in production.
+			name:   "annotation",
+			config: "config-annotation.json",
+			query:  "start=2020-01-01&end=2020-01-03&step=exports",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bq := newClient(t)
+			configs := loadConfigs(t, tt.config)
+			out := t.TempDir()
+			wr := output.NewLocalWriter(out)
+
+			exporters := map[string]pipeline.Exporter{}
+			for name, c := range configs {
+				formatterName := c.Formatter
+				if formatterName == "" {
+					formatterName = formatter.Default
+				}
+				f, err := formatter.New(formatterName, c)
+				rtx.Must(err, "invalid formatter for config %s", name)
+				exporters[name] = exporter.New(bq, project, wr, f)
+			}
+			h := pipeline.NewHandler(bq, exporters, tiles.New(bq, project, wr),
+				configs)
+
+			req := httptest.NewRequest(http.MethodPost,
+				"/v0/pipeline?"+tt.query, nil)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("pipeline returned %d: %s", rw.Code,
+					rw.Body.String())
+			}
+			var result struct {
+				CompletedSteps []string
+				Errors         []string
+			}
+			rtx.Must(json.Unmarshal(rw.Body.Bytes(), &result),
+				"cannot parse the pipeline result")
+			if len(result.Errors) != 0 {
+				t.Fatalf("pipeline returned errors: %v", result.Errors)
+			}
+			checkGolden(t, out, filepath.Join("testdata", "golden", tt.name))
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Thresholds on the fraction of the byte budget in use above which the query
+// concurrency is halved, and below which it is increased again.
+const (
+	highWatermark = 0.75
+	lowWatermark  = 0.25
+)
+
+var (
+	maxBytesInFlight = flag.Int64("exporter.max-bytes-in-flight", 2<<30,
+		"Maximum bytes of marshalled files waiting to be uploaded, 0 for no limit")
+
+	bytesInFlightMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stats_pipeline_exporter_bytes_in_flight",
+		Help: "Bytes of marshalled files waiting to be uploaded",
+	})
+
+	maxBytesInFlightMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stats_pipeline_exporter_max_bytes_in_flight",
+		Help: "Maximum bytes of marshalled files waiting to be uploaded",
+	})
+
+	queryConcurrencyMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stats_pipeline_exporter_query_concurrency",
+		Help: "Maximum number of export queries currently allowed to run",
+	}, []string{
+		"table",
+	})
+
+	// The byte budget shared by all the exporters in this process.
+	uploadBudget     *byteBudget
+	uploadBudgetOnce sync.Once
+)
+
+// sharedBudget returns the byte budget shared by all the exporters, sized
+// according to the -exporter.max-bytes-in-flight flag.
+func sharedBudget() *byteBudget {
+	uploadBudgetOnce.Do(func() {
+		uploadBudget = newByteBudget(*maxBytesInFlight)
+		maxBytesInFlightMetric.Set(float64(*maxBytesInFlight))
+	})
+	return uploadBudget
+}
+
+// byteBudget is a semaphore limiting the bytes of marshalled content waiting
+// to be uploaded. A nil byteBudget, or one with a limit <= 0, is unlimited.
+type byteBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+// newByteBudget returns a byteBudget allowing up to limit bytes in flight.
+func newByteBudget(limit int64) *byteBudget {
+	return &byteBudget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes fit in the budget or ctx is canceled. Content
+// larger than the whole budget is admitted when nothing else is in flight.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil || b.limit <= 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			bytesInFlightMetric.Set(float64(b.used))
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns n bytes to the budget.
+func (b *byteBudget) release(n int64) {
+	if b == nil || b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	bytesInFlightMetric.Set(float64(b.used))
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// usage returns the fraction of the budget in use.
+func (b *byteBudget) usage() float64 {
+	if b == nil || b.limit <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return float64(b.used) / float64(b.limit)
+}
+
+// queryLimiter limits the number of export queries running at the same time
+// to a value between 1 and max. When uploads lag behind queries, i.e. the
+// byte budget is more than highWatermark full, the limit is halved. When the
+// budget is less than lowWatermark full, it is increased by one. A nil
+// queryLimiter is unlimited.
+type queryLimiter struct {
+	mu      sync.Mutex
+	table   string
+	budget  *byteBudget
+	max     int
+	limit   int
+	running int
+	changed chan struct{}
+}
+
+// newQueryLimiter returns a queryLimiter allowing up to max queries at the
+// same time, adjusted according to the given budget's usage.
+func newQueryLimiter(table string, max int, budget *byteBudget) *queryLimiter {
+	if max < 1 {
+		max = 1
+	}
+	queryConcurrencyMetric.WithLabelValues(table).Set(float64(max))
+	return &queryLimiter{
+		table:   table,
+		budget:  budget,
+		max:     max,
+		limit:   max,
+		changed: make(chan struct{}),
+	}
+}
+
+// adjust updates the limit according to the budget's usage. It must be called
+// with l.mu held.
+func (l *queryLimiter) adjust() {
+	limit := l.limit
+	switch usage := l.budget.usage(); {
+	case usage > highWatermark:
+		limit = limit / 2
+	case usage < lowWatermark:
+		limit++
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > l.max {
+		limit = l.max
+	}
+	if limit != l.limit {
+		l.limit = limit
+		queryConcurrencyMetric.WithLabelValues(l.table).Set(float64(limit))
+	}
+}
+
+// acquire blocks until a query can run or ctx is canceled. While waiting, the
+// limit is periodically adjusted.
+func (l *queryLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		l.mu.Lock()
+		l.adjust()
+		if l.running < l.limit {
+			l.running++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release signals that a query has completed.
+func (l *queryLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
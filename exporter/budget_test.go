@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_byteBudget(t *testing.T) {
+	ctx := context.Background()
+	b := newByteBudget(100)
+	b.acquire(ctx, 60)
+	b.acquire(ctx, 40)
+	if got := b.usage(); got != 1 {
+		t.Errorf("usage() = %v, want 1", got)
+	}
+
+	// This must block until enough bytes are released.
+	acquired := make(chan bool)
+	go func() {
+		b.acquire(ctx, 50)
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("acquire() didn't block on a full budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(40)
+	select {
+	case <-acquired:
+		t.Fatalf("acquire() didn't wait for enough bytes")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(60)
+	<-acquired
+	b.release(50)
+
+	// Waiting for the budget stops when the context is canceled.
+	b.acquire(ctx, 100)
+	canceled, cancel := context.WithCancel(ctx)
+	errc := make(chan error)
+	go func() {
+		errc <- b.acquire(canceled, 50)
+	}()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("acquire() error = %v, want %v", err, context.Canceled)
+	}
+	b.release(100)
+
+	// Content larger than the budget is admitted when the budget is empty.
+	b.acquire(ctx, 500)
+	b.release(500)
+	if got := b.usage(); got != 0 {
+		t.Errorf("usage() = %v, want 0", got)
+	}
+
+	// A nil or unlimited budget never blocks.
+	var nilBudget *byteBudget
+	nilBudget.acquire(ctx, 1<<40)
+	nilBudget.release(1 << 40)
+	unlimited := newByteBudget(0)
+	unlimited.acquire(ctx, 1<<40)
+	if got := unlimited.usage(); got != 0 {
+		t.Errorf("usage() = %v, want 0", got)
+	}
+}
+
+func Test_queryLimiter(t *testing.T) {
+	b := newByteBudget(100)
+	l := newQueryLimiter("test", 8, b)
+	ctx := context.Background()
+
+	// With an empty budget, all the queries can run.
+	for i := 0; i < 8; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatalf("acquire() returned err: %v", err)
+		}
+	}
+	// With uploads lagging, the limit is halved on every adjustment.
+	b.acquire(ctx, 80)
+	for i := 0; i < 8; i++ {
+		l.release()
+	}
+	l.acquire(ctx)
+	if l.limit != 4 {
+		t.Errorf("limit = %d, want 4", l.limit)
+	}
+	l.acquire(ctx)
+	if l.limit != 2 {
+		t.Errorf("limit = %d, want 2", l.limit)
+	}
+
+	// The next query must wait for the running ones to complete.
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(timeout); err == nil {
+		t.Errorf("acquire() expected err, got nil")
+	}
+	if l.limit != 1 {
+		t.Errorf("limit = %d, want 1", l.limit)
+	}
+
+	// Once uploads have caught up, the limit increases again.
+	b.release(80)
+	l.release()
+	l.release()
+	l.acquire(ctx)
+	if l.limit != 2 {
+		t.Errorf("limit = %d, want 2", l.limit)
+	}
+
+	// A nil limiter never blocks.
+	var nilLimiter *queryLimiter
+	if err := nilLimiter.acquire(ctx); err != nil {
+		t.Errorf("acquire() returned err: %v", err)
+	}
+	nilLimiter.release()
+}
@@ -0,0 +1,577 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/m-lab/stats-pipeline/logging"
+	"github.com/m-lab/stats-pipeline/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+var stagingPrefix = flag.String("exporter.staging-prefix", "staging/export-data",
+	"GCS prefix under which EXPORT DATA writes the exported files before "+
+		"they are converted and written to their output path")
+
+// ExportDataExporter is an exporter letting BigQuery write the results of the
+// export queries to GCS with EXPORT DATA, instead of reading every row through
+// the BigQuery API. It is meant for configs whose output is one file per
+// partition: the rows of each partition are staged as newline-delimited JSON
+// under -exporter.staging-prefix in the staging bucket, then converted with the
+// formatter and written to the output path of the partition's rows. Staged
+// files are read one at a time and, if the output and the formatter support
+// it, streamed to the output instead of being held in memory. Staged files are
+// deleted once processed.
+type ExportDataExporter struct {
+	*JSONExporter
+
+	gcs    stiface.Client
+	bucket string
+}
+
+// NewExportData creates a new ExportDataExporter staging the exported files
+// in the given GCS bucket.
+func NewExportData(bqClient bqiface.Client, projectID string,
+	gcs stiface.Client, bucket string, output Writer,
+	format Formatter) *ExportDataExporter {
+	return &ExportDataExporter{
+		JSONExporter: New(bqClient, projectID, output, format),
+		gcs:          gcs,
+		bucket:       bucket,
+	}
+}
+
+// Export exports the same files as JSONExporter.Export, but every partition's
+// rows must map to a single output path. The export of a partition fails
+// otherwise, and the config must use the JSONExporter instead.
+//
+// Values are written as in BigQuery's JSON export format, except INT64 values
+// which are written as numbers instead of strings. The order of rows within a
+// file is only preserved when BigQuery writes the partition to a single file.
+func (exporter *ExportDataExporter) Export(ctx context.Context,
+	config config.Config, queryTpl *template.Template,
+	period config.Period, incremental bool) (err error) {
+	ctx, span := startExportSpan(ctx, config, period, incremental)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+	if err := checkCollisionMode(config.OutputCollisions); err != nil {
+		return err
+	}
+	outputPath, err := parseOutputPath(config.OutputPath)
+	if err != nil {
+		return err
+	}
+	outputPath, err = outputPath.forPeriod(period)
+	if err != nil {
+		return err
+	}
+	sourceTable := exporter.format.Source(exporter.projectID, config, period)
+	sel, err := exporter.getExportPartitions(ctx, sourceTable, config.DateField,
+		outputPath.fields, period, incremental)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot list partitions", "error", err)
+		return err
+	}
+
+	// Forget the output paths emitted by previous exports.
+	exporter.collisionMode = config.OutputCollisions
+	exporter.paths = map[string]bool{}
+	exporter.pending = map[string][]bqRow{}
+	exporter.collisions = 0
+
+	exporter.year = strconv.Itoa(period.Start.Year())
+	resetProgressMetrics(config.Table, exporter.year, len(sel.partitions))
+
+	queryJobs := make([]*QueryJob, 0, len(sel.partitions))
+	for _, p := range sel.partitions {
+		query, params, err := exporter.partitionQuery(queryTpl, sourceTable,
+			period, sel, p)
+		if err != nil {
+			return err
+		}
+		queryJobs = append(queryJobs, &QueryJob{
+			name:       config.Table,
+			shard:      p,
+			query:      query,
+			params:     params,
+			fields:     outputPath.fields,
+			outputPath: outputPath,
+		})
+	}
+	if len(queryJobs) == 0 {
+		return nil
+	}
+
+	// The JSON export format encodes INT64 values as strings, so the
+	// schema of the results is needed to convert them back.
+	schema, err := exporter.querySchema(ctx, queryJobs[0])
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get the schema", "error", err)
+		return err
+	}
+
+	// Export the partitions in parallel, each under its own staging prefix.
+	run := time.Now().UTC().Format("20060102T150405.000000Z")
+	var mu sync.Mutex
+	var firstErr error
+	failed := 0
+	queue := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < *nQueryWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				prefix := fmt.Sprintf("%s/%s/%s/%d/", *stagingPrefix,
+					config.Table, run, i)
+				err := exporter.exportPartition(ctx, queryJobs[i], schema, prefix)
+				queryProcessedMetric.WithLabelValues(config.Table, exporter.year).Inc()
+				if err != nil {
+					slog.ErrorContext(ctx, "cannot export partition",
+						"shard", queryJobs[i].shard, "error", err)
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	// Stop dispatching the partitions once the context is canceled, e.g.
+	// because the run has been cancelled.
+dispatch:
+	for i := range queryJobs {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	// Merged files are written once all the partitions are exported.
+	exporter.writePending(ctx, config.Table)
+
+	if firstErr != nil {
+		return fmt.Errorf("%d/%d partitions of %s failed, first error: %v",
+			failed, len(queryJobs), config.Table, firstErr)
+	}
+	if exporter.collisionMode == failOnCollisions && exporter.collisions > 0 {
+		return fmt.Errorf("%d output path collisions in %s",
+			exporter.collisions, config.Table)
+	}
+	return nil
+}
+
+// querySchema returns the schema of a query's results, using a dry run.
+func (exporter *ExportDataExporter) querySchema(ctx context.Context,
+	j *QueryJob) (bigquery.Schema, error) {
+	q := exporter.bqClient.Query(j.query)
+	qc := bqiface.QueryConfig{}
+	qc.Q = j.query
+	qc.Parameters = j.params
+	qc.DryRun = true
+	jobs.Configure(ctx, q, qc, jobIDPrefix("schema", j.name, j.query, j.params))
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return nil, fmt.Errorf("no statistics for the dry run of: %s", j.query)
+	}
+	details, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return nil, fmt.Errorf("no schema for the dry run of: %s", j.query)
+	}
+	return details.Schema, nil
+}
+
+// exportPartition runs EXPORT DATA for a partition's query, then writes the
+// staged rows to their output path and deletes the staged files.
+func (exporter *ExportDataExporter) exportPartition(ctx context.Context,
+	j *QueryJob, schema bigquery.Schema, prefix string) (err error) {
+	ctx, span := startQueryJobSpan(ctx, j)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+	defer exporter.deleteStaged(ctx, prefix)
+
+	stmt := fmt.Sprintf(
+		"EXPORT DATA OPTIONS(uri='gs://%s/%s*.json', format='JSON', overwrite=true) AS\n%s",
+		exporter.bucket, prefix, j.query)
+	ctx = logging.With(ctx, "shard", j.shard)
+	slog.DebugContext(ctx, "running query", "query", stmt)
+	q := exporter.bqClient.Query(stmt)
+	qc := bqiface.QueryConfig{}
+	qc.Q = stmt
+	qc.Parameters = j.params
+	jobs.Configure(ctx, q, qc, jobIDPrefix("exports", j.name, stmt, j.params))
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	ctx = logging.With(ctx, "job_id", job.ID())
+	status, err := jobs.Wait(ctx, job)
+	tracing.SetJob(span, job, status)
+	if err != nil {
+		return err
+	}
+	if status.Err() != nil {
+		return status.Err()
+	}
+	if err := jobs.Charge(ctx, status); err != nil {
+		return err
+	}
+	if status.Statistics != nil {
+		if details, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			bytesProcessedMetric.WithLabelValues(j.name, exporter.year).Add(
+				float64(details.TotalBytesProcessed))
+		}
+	}
+
+	if sw, sf, ok := exporter.canStreamStaged(); ok {
+		return exporter.streamStaged(ctx, j, prefix, schema, sw, sf)
+	}
+	rows, err := exporter.readStaged(ctx, prefix, schema)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	objName, err := j.outputPath.Execute(rows[0])
+	if err != nil {
+		writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+		return err
+	}
+	for _, row := range rows[1:] {
+		p, err := j.outputPath.Execute(row)
+		if err != nil {
+			writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+			return err
+		}
+		if p != objName {
+			writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+			return errMultipleFiles(objName, p)
+		}
+	}
+	if !exporter.trackPath(ctx, j.name, objName, rows) {
+		return nil
+	}
+	return exporter.writeFile(ctx, j.name, objName, rows)
+}
+
+// errMultipleFiles returns the error for a partition whose rows map to more
+// than one output path.
+func errMultipleFiles(objName, other string) error {
+	return fmt.Errorf("rows of the same partition map to %s and %s, "+
+		"EXPORT DATA requires a single file per partition", objName, other)
+}
+
+// errSkipPartition stops reading the staged rows of a partition whose file
+// must not be written.
+var errSkipPartition = errors.New("skip partition")
+
+// canStreamStaged returns the output and formatter to use for streaming the
+// staged rows, if possible. Unlike the JSONExporter, -exporter.stream-uploads
+// isn't required: the files are always written by the partition workers, so
+// streaming them doesn't bypass -exporter.max-bytes-in-flight.
+func (exporter *ExportDataExporter) canStreamStaged() (StreamWriter,
+	StreamFormatter, bool) {
+	if exporter.collisionMode == mergeCollisions {
+		return nil, nil, false
+	}
+	sw, ok := exporter.output.(StreamWriter)
+	if !ok {
+		return nil, nil, false
+	}
+	sf, ok := exporter.format.(StreamFormatter)
+	if !ok {
+		return nil, nil, false
+	}
+	return sw, sf, true
+}
+
+// streamStaged writes the rows staged under prefix to their output path while
+// reading them, so that the partition's rows are never all held in memory. The
+// file is not created if any row fails or maps to another path.
+func (exporter *ExportDataExporter) streamStaged(ctx context.Context,
+	j *QueryJob, prefix string, schema bigquery.Schema, sw StreamWriter,
+	sf StreamFormatter) error {
+	var file *streamFile
+	err := exporter.forEachStaged(ctx, prefix, schema, func(row bqRow) error {
+		objName, err := j.outputPath.Execute(row)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			if !exporter.trackPath(ctx, j.name, objName, nil) {
+				return errSkipPartition
+			}
+			fileCtx, span := startUploadSpan(ctx, objName)
+			fileCtx, cancel := context.WithCancel(fileCtx)
+			w, err := sw.NewWriter(fileCtx, objName)
+			if err != nil {
+				cancel()
+				tracing.SetError(span, err)
+				span.End()
+				return fmt.Errorf("cannot write %s: %v", objName, err)
+			}
+			counter := &countingWriter{w: w}
+			file = &streamFile{
+				objName: objName,
+				w:       w,
+				counter: counter,
+				enc:     sf.NewEncoder(counter),
+				cancel:  cancel,
+				span:    span,
+			}
+		}
+		if objName != file.objName {
+			return errMultipleFiles(file.objName, objName)
+		}
+		return file.enc.Encode(row)
+	})
+	if err == errSkipPartition {
+		return nil
+	}
+	if file == nil {
+		if err != nil {
+			writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+		}
+		return err
+	}
+	if err == nil {
+		err = file.enc.Close()
+	}
+	if err != nil {
+		// Canceling the context makes sure the file is not created.
+		file.cancel()
+		file.w.Close()
+	} else {
+		err = file.w.Close()
+		file.cancel()
+		if err != nil {
+			err = fmt.Errorf("cannot write %s: %v", file.objName, err)
+		}
+	}
+	file.span.SetAttributes(attribute.Int64("bytes", file.counter.n))
+	tracing.SetError(file.span, err)
+	file.span.End()
+	writtenFiles.WithLabelValues(j.name, exporter.year, fmt.Sprintf("%t", err == nil)).Inc()
+	if err != nil {
+		return err
+	}
+	uploadedBytesMetric.WithLabelValues(j.name, exporter.year).Add(float64(file.counter.n))
+	return nil
+}
+
+// readStaged reads the rows of the newline-delimited JSON files staged under
+// prefix, in the order of the files' names. The partitioning field is removed
+// from the rows.
+func (exporter *ExportDataExporter) readStaged(ctx context.Context,
+	prefix string, schema bigquery.Schema) ([]bqRow, error) {
+	var rows []bqRow
+	err := exporter.forEachStaged(ctx, prefix, schema, func(row bqRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// forEachStaged calls fn for each row of the newline-delimited JSON files
+// staged under prefix, in the order of the files' names, reading one file at a
+// time. The partitioning field is removed from the rows. It stops at the first
+// error returned by fn.
+func (exporter *ExportDataExporter) forEachStaged(ctx context.Context,
+	prefix string, schema bigquery.Schema, fn func(bqRow) error) error {
+	names, err := exporter.listStaged(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := exporter.forEachStagedRow(ctx, name, schema, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachStagedRow calls fn for each row of a single staged file.
+func (exporter *ExportDataExporter) forEachStagedRow(ctx context.Context,
+	name string, schema bigquery.Schema, fn func(bqRow) error) error {
+	r, err := exporter.gcs.Bucket(exporter.bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var row map[string]interface{}
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", name, err)
+		}
+		delete(row, partitionField)
+		if err := fn(exportedRow(schema, row)); err != nil {
+			return err
+		}
+	}
+}
+
+// listStaged returns the names of the files staged under prefix.
+func (exporter *ExportDataExporter) listStaged(ctx context.Context,
+	prefix string) ([]string, error) {
+	it := exporter.gcs.Bucket(exporter.bucket).Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+	var names []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+	return names, nil
+}
+
+// deleteStaged deletes the files staged under prefix. Errors are only logged.
+func (exporter *ExportDataExporter) deleteStaged(ctx context.Context,
+	prefix string) {
+	names, err := exporter.listStaged(ctx, prefix)
+	if err != nil {
+		slog.WarnContext(ctx, "cannot list staged files", "prefix", prefix,
+			"error", err)
+		return
+	}
+	for _, name := range names {
+		err := exporter.gcs.Bucket(exporter.bucket).Object(name).Delete(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "cannot delete staged file", "name", name,
+				"error", err)
+		}
+	}
+}
+
+// writeFile marshals rows and writes them to objName.
+func (exporter *ExportDataExporter) writeFile(ctx context.Context, table,
+	objName string, rows []bqRow) error {
+	ctx, span := startUploadSpan(ctx, objName)
+	defer span.End()
+	content, err := exporter.format.Marshal(rows)
+	if err == nil {
+		err = exporter.output.Write(ctx, objName, content)
+	}
+	span.SetAttributes(attribute.Int("bytes", len(content)))
+	tracing.SetError(span, err)
+	writtenFiles.WithLabelValues(table, exporter.year, fmt.Sprintf("%t", err == nil)).Inc()
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %v", objName, err)
+	}
+	uploadedBytesMetric.WithLabelValues(table, exporter.year).Add(float64(len(content)))
+	return nil
+}
+
+// writePending writes the files held back when merging collisions, in output
+// path order.
+func (exporter *ExportDataExporter) writePending(ctx context.Context,
+	table string) {
+	exporter.pathsMu.Lock()
+	pending := exporter.pending
+	exporter.pending = map[string][]bqRow{}
+	exporter.pathsMu.Unlock()
+
+	objNames := make([]string, 0, len(pending))
+	for objName := range pending {
+		objNames = append(objNames, objName)
+	}
+	sort.Strings(objNames)
+	for _, objName := range objNames {
+		if err := exporter.writeFile(ctx, table, objName, pending[objName]); err != nil {
+			slog.ErrorContext(ctx, "cannot write merged file", "error", err)
+		}
+	}
+}
+
+// exportedRow converts a row read from BigQuery's JSON export format, where
+// INT64 values are strings, so that integers are written as numbers.
+func exportedRow(schema bigquery.Schema, row map[string]interface{}) bqRow {
+	out := make(bqRow, len(row))
+	for k, v := range row {
+		out[k] = v
+	}
+	for _, f := range schema {
+		v, ok := row[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+		if f.Repeated {
+			if items, ok := v.([]interface{}); ok {
+				values := make([]bigquery.Value, len(items))
+				for i, item := range items {
+					values[i] = exportedValue(f, item)
+				}
+				out[f.Name] = values
+			}
+			continue
+		}
+		out[f.Name] = exportedValue(f, v)
+	}
+	return out
+}
+
+// exportedValue converts a single value of the given field.
+func exportedValue(f *bigquery.FieldSchema, v interface{}) bigquery.Value {
+	switch f.Type {
+	case bigquery.IntegerFieldType:
+		if s, ok := v.(string); ok && s != "" &&
+			strings.TrimLeft(s, "-0123456789") == "" {
+			return json.Number(s)
+		}
+	case bigquery.RecordFieldType:
+		if m, ok := v.(map[string]interface{}); ok {
+			return exportedRow(f.Schema, m)
+		}
+	}
+	return v
+}
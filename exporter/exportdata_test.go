@@ -0,0 +1,450 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/formatter"
+	"google.golang.org/api/iterator"
+)
+
+// exportDataClient is a bqiface.Client simulating EXPORT DATA: running an
+// export statement stages the rows of the exported partition in the bucket.
+type exportDataClient struct {
+	bqiface.Client
+
+	mu         sync.Mutex
+	partitions []bqRow
+	// staged maps a partition's WHERE clause to the files staged for it.
+	staged   map[string][]string
+	schema   bigquery.Schema
+	runErr   error
+	bucket   *stagingBucket
+	exported []string
+}
+
+func (c *exportDataClient) Query(q string) bqiface.Query {
+	return &exportDataQuery{client: c, q: q}
+}
+
+type exportDataQuery struct {
+	bqiface.Query
+	client      *exportDataClient
+	q           string
+	qc          bqiface.QueryConfig
+	jobIDConfig bigquery.JobIDConfig
+}
+
+func (q *exportDataQuery) SetQueryConfig(qc bqiface.QueryConfig) {
+	q.qc = qc
+}
+
+func (q *exportDataQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobIDConfig
+}
+
+var exportURIRegexp = regexp.MustCompile(`uri='gs://[^/]+/([^']*)\*\.json'`)
+
+func (q *exportDataQuery) Run(ctx context.Context) (bqiface.Job, error) {
+	status := &bigquery.JobStatus{
+		State: bigquery.Done,
+		Statistics: &bigquery.JobStatistics{
+			Details: &bigquery.QueryStatistics{
+				Schema:              q.client.schema,
+				TotalBytesProcessed: 10,
+			},
+		},
+	}
+	if q.qc.DryRun {
+		return &exportDataJob{status: status}, nil
+	}
+	m := exportURIRegexp.FindStringSubmatch(q.q)
+	if m == nil {
+		// Any other query lists the partitions.
+		return &exportDataJob{status: status, rows: q.client.partitions}, nil
+	}
+	if q.client.runErr != nil {
+		return nil, q.client.runErr
+	}
+	q.client.mu.Lock()
+	defer q.client.mu.Unlock()
+	q.client.exported = append(q.client.exported, q.q)
+	for where, files := range q.client.staged {
+		if !strings.Contains(q.q, where) {
+			continue
+		}
+		for i, content := range files {
+			name := m[1] + strings.Repeat("0", 11) + string(rune('0'+i)) + ".json"
+			q.client.bucket.put(name, content)
+		}
+	}
+	return &exportDataJob{status: status}, nil
+}
+
+type exportDataJob struct {
+	bqiface.Job
+	status *bigquery.JobStatus
+	rows   []bqRow
+}
+
+func (j *exportDataJob) ID() string {
+	return "job-id"
+}
+
+func (j *exportDataJob) LastStatus() *bigquery.JobStatus {
+	return j.status
+}
+
+func (j *exportDataJob) Wait(context.Context) (*bigquery.JobStatus, error) {
+	return j.status, nil
+}
+
+func (j *exportDataJob) Read(context.Context) (bqiface.RowIterator, error) {
+	return &mockRowIterator{rows: j.rows}, nil
+}
+
+// stagingBucket is a GCS bucket whose objects can be listed and deleted.
+type stagingBucket struct {
+	stiface.BucketHandle
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func (b *stagingBucket) put(name, content string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[name] = content
+}
+
+func (b *stagingBucket) Object(name string) stiface.ObjectHandle {
+	return &stagingObject{bucket: b, name: name}
+}
+
+func (b *stagingBucket) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	it := &stagingObjectIterator{}
+	for name := range b.objects {
+		if strings.HasPrefix(name, q.Prefix) {
+			it.names = append(it.names, name)
+		}
+	}
+	sort.Strings(it.names)
+	return it
+}
+
+type stagingObjectIterator struct {
+	stiface.ObjectIterator
+	names []string
+}
+
+func (it *stagingObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(it.names) == 0 {
+		return nil, iterator.Done
+	}
+	name := it.names[0]
+	it.names = it.names[1:]
+	return &storage.ObjectAttrs{Name: name}, nil
+}
+
+type stagingObject struct {
+	stiface.ObjectHandle
+	bucket *stagingBucket
+	name   string
+}
+
+func (o *stagingObject) NewReader(context.Context) (stiface.Reader, error) {
+	o.bucket.mu.Lock()
+	defer o.bucket.mu.Unlock()
+	content, ok := o.bucket.objects[o.name]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return &stagingReader{r: strings.NewReader(content)}, nil
+}
+
+func (o *stagingObject) Delete(context.Context) error {
+	o.bucket.mu.Lock()
+	defer o.bucket.mu.Unlock()
+	delete(o.bucket.objects, o.name)
+	return nil
+}
+
+type stagingReader struct {
+	stiface.Reader
+	r io.Reader
+}
+
+func (r *stagingReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r *stagingReader) Close() error {
+	return nil
+}
+
+type stagingClient struct {
+	stiface.Client
+	bucket *stagingBucket
+}
+
+func (c *stagingClient) Bucket(name string) stiface.BucketHandle {
+	return c.bucket
+}
+
+// mapWriter is a Writer keeping all the files in memory.
+type mapWriter struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (w *mapWriter) Write(ctx context.Context, path string, content []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files[path] = string(content)
+	return nil
+}
+
+// mapStreamWriter is a mapWriter which can also stream files.
+type mapStreamWriter struct {
+	*mapWriter
+	streamed int
+}
+
+func (w *mapStreamWriter) NewWriter(ctx context.Context, path string) (io.WriteCloser, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.streamed++
+	return &mapStream{ctx: ctx, w: w.mapWriter, path: path}, nil
+}
+
+// mapStream only writes its content to the mapWriter when closed, unless its
+// context has been canceled.
+type mapStream struct {
+	bytes.Buffer
+	ctx  context.Context
+	w    *mapWriter
+	path string
+}
+
+func (s *mapStream) Close() error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	return s.w.Write(s.ctx, s.path, s.Bytes())
+}
+
+func TestExportDataExporter_Export(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "year", Type: bigquery.IntegerFieldType},
+		{Name: "date", Type: bigquery.DateFieldType},
+		{Name: "samples", Type: bigquery.IntegerFieldType},
+		{Name: "buckets", Type: bigquery.FloatFieldType, Repeated: true},
+		{Name: "shard", Type: bigquery.IntegerFieldType},
+		{Name: "nested", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "count", Type: bigquery.IntegerFieldType, Repeated: true},
+		}},
+	}
+	tests := []struct {
+		name       string
+		outputPath string
+		collisions string
+		staged     map[string][]string
+		runErr     error
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			outputPath: "{{ .year }}/output.json",
+			staged: map[string][]string{
+				"shard = 1": {
+					`{"year":"2020","date":"2020-01-01","samples":"-5","buckets":[1.5,2],"shard":"1"}` + "\n" +
+						`{"year":"2020","date":"2020-01-02","samples":null,"buckets":[],"shard":"1","nested":{"count":["1","2"]}}` + "\n",
+				},
+				"shard = 2": {
+					`{"year":"2021","date":"2021-01-01","samples":"7","shard":"2"}` + "\n",
+					`{"year":"2021","date":"2021-01-02","samples":"8","shard":"2"}` + "\n",
+				},
+			},
+			want: map[string]string{
+				"2020/output.json": `[{"buckets":[1.5,2],"date":"2020-01-01","samples":-5,"year":2020},{"buckets":[],"date":"2020-01-02","nested":{"count":[1,2]},"samples":null,"year":2020}]`,
+				"2021/output.json": `[{"date":"2021-01-01","samples":7,"year":2021},{"date":"2021-01-02","samples":8,"year":2021}]`,
+			},
+		},
+		{
+			name:       "multiple-files-per-partition",
+			outputPath: "{{ .date }}/output.json",
+			staged: map[string][]string{
+				"shard = 1": {
+					`{"year":"2020","date":"2020-01-01","shard":"1"}` + "\n" +
+						`{"year":"2020","date":"2020-01-02","shard":"1"}` + "\n",
+				},
+				"shard = 2": {
+					`{"year":"2021","date":"2021-01-01","shard":"2"}` + "\n",
+				},
+			},
+			want: map[string]string{
+				"2021-01-01/output.json": `[{"date":"2021-01-01","year":2021}]`,
+			},
+			wantErr: true,
+		},
+		{
+			name:       "merge-collisions",
+			outputPath: "output.{{ .year | printf \"%.0s\" }}json",
+			collisions: mergeCollisions,
+			staged: map[string][]string{
+				"shard = 1": {`{"year":"2020","shard":"1"}` + "\n"},
+				"shard = 2": {`{"year":"2021","shard":"2"}` + "\n"},
+			},
+			want: map[string]string{
+				"output.json": `[{"year":2020},{"year":2021}]`,
+			},
+		},
+		{
+			name:       "fail-on-collisions",
+			outputPath: "output.{{ .year | printf \"%.0s\" }}json",
+			collisions: failOnCollisions,
+			staged: map[string][]string{
+				"shard = 1": {`{"year":"2020","shard":"1"}` + "\n"},
+				"shard = 2": {`{"year":"2021","shard":"2"}` + "\n"},
+			},
+			want: map[string]string{
+				"output.json": `[{"year":2020}]`,
+			},
+			wantErr: true,
+		},
+		{
+			name:       "invalid-json",
+			outputPath: "{{ .year }}/output.json",
+			staged: map[string][]string{
+				"shard = 1": {`{"year":`},
+			},
+			want:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:       "invalid-json-after-rows",
+			outputPath: "{{ .year }}/output.json",
+			staged: map[string][]string{
+				"shard = 1": {
+					`{"year":"2020","shard":"1"}` + "\n",
+					`{"year":`,
+				},
+			},
+			want:    map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:       "run-error",
+			outputPath: "{{ .year }}/output.json",
+			runErr:     errors.New("export failed"),
+			want:       map[string]string{},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			tt, stream := tt, stream
+			t.Run(fmt.Sprintf("%s/stream=%t", tt.name, stream), func(t *testing.T) {
+				bucket := &stagingBucket{objects: map[string]string{}}
+				bq := &exportDataClient{
+					partitions: []bqRow{{"shard": int64(1)}, {"shard": int64(2)}},
+					staged:     tt.staged,
+					schema:     schema,
+					runErr:     tt.runErr,
+					bucket:     bucket,
+				}
+				out := &mapWriter{files: map[string]string{}}
+				var output Writer = out
+				sw := &mapStreamWriter{mapWriter: out}
+				if stream {
+					output = sw
+				}
+				exporter := NewExportData(bq, "project",
+					&stagingClient{bucket: bucket}, "bucket", output,
+					formatter.NewStatsQueryFormatter())
+				period, err := config.PeriodOf(time.Date(2020, 1, 1, 0, 0, 0, 0,
+					time.UTC), config.Yearly)
+				if err != nil {
+					t.Fatalf("PeriodOf() returned err: %v", err)
+				}
+				tpl := template.Must(template.New("query").Parse(
+					"SELECT * FROM {{ .sourceTable }} WHERE shard = {{ .partitionID }}"))
+				// The collisions are only detected if files are written in
+				// order.
+				oldWorkers := *nQueryWorkers
+				*nQueryWorkers = 1
+				defer func() { *nQueryWorkers = oldWorkers }()
+				err = exporter.Export(context.Background(), config.Config{
+					Dataset:          "dataset",
+					Table:            "table",
+					OutputPath:       tt.outputPath,
+					OutputCollisions: tt.collisions,
+				}, tpl, period, false)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Export() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !reflect.DeepEqual(out.files, tt.want) {
+					t.Errorf("Export() wrote %v, want %v", out.files, tt.want)
+				}
+				if len(bucket.objects) != 0 {
+					t.Errorf("Export() left staged files: %v", bucket.objects)
+				}
+				for _, stmt := range bq.exported {
+					if !strings.Contains(stmt, "uri='gs://bucket/staging/export-data/table/") {
+						t.Errorf("Export() ran %q, want staging in the bucket", stmt)
+					}
+				}
+				// Merged files can't be streamed.
+				canStream := stream && tt.collisions != mergeCollisions
+				if canStream && len(tt.want) > 0 && sw.streamed == 0 ||
+					!canStream && sw.streamed > 0 {
+					t.Errorf("Export() streamed %d files, want streaming %t",
+						sw.streamed, canStream)
+				}
+			})
+		}
+	}
+}
+
+func Test_exportedRow(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "int", Type: bigquery.IntegerFieldType},
+		{Name: "str", Type: bigquery.StringFieldType},
+		{Name: "bad", Type: bigquery.IntegerFieldType},
+	}
+	row := map[string]interface{}{
+		"int":   "42",
+		"str":   "42",
+		"bad":   "",
+		"other": "x",
+	}
+	got := exportedRow(schema, row)
+	want := bqRow{
+		"int":   json.Number("42"),
+		"str":   "42",
+		"bad":   "",
+		"other": "x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exportedRow() = %#v, want %#v", got, want)
+	}
+}
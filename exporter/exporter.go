@@ -6,8 +6,10 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"regexp"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"text/template"
@@ -16,8 +18,13 @@ import (
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/formatter"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/m-lab/stats-pipeline/logging"
+	"github.com/m-lab/stats-pipeline/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/iterator"
 )
 
@@ -25,48 +32,60 @@ import (
 // queries.
 const partitionField = "shard"
 
+const dateFormat = "2006-01-02"
+
+// Possible values for config.OutputCollisions.
+const (
+	reportCollisions = "report"
+	failOnCollisions = "fail"
+	mergeCollisions  = "merge"
+)
+
+// The exporter's counters are never reset, so that their history is accurate
+// across runs. They are labelled by table and by the year of the exported
+// period. Only the progress gauges of the table and year being exported are
+// reset when an export starts.
 var (
-	fieldRegex           = regexp.MustCompile(`{{\s*\.([A-Za-z0-9_]+)\s*}}`)
-	bytesProcessedMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "stats_pipeline_exporter_bytes_processed",
+	bytesProcessedMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_exporter_bytes_processed_total",
 		Help: "Bytes processed by the exporter",
 	}, []string{
-		"table",
+		"table", "year",
 	})
 
-	cacheHitMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "stats_pipeline_exporter_cache_hits",
+	cacheHitMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_exporter_cache_hits_total",
 		Help: "Number of cache hits",
 	}, []string{
-		"table",
+		"table", "year",
 	})
 
-	uploadedBytesMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "stats_pipeline_exporter_uploaded_bytes",
+	uploadedBytesMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_exporter_uploaded_bytes_total",
 		Help: "Bytes uploaded to GCS",
 	}, []string{
-		"table",
+		"table", "year",
 	})
 
 	writtenFiles = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "stats_pipeline_exporter_written_files_total",
 		Help: "Files written to disk",
 	}, []string{
-		"table", "success",
+		"table", "year", "success",
 	})
 
 	queryTotalMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "stats_pipeline_exporter_queries",
-		Help: "Export queries to be processed for the current table",
+		Help: "Export queries to be processed for the current export",
 	}, []string{
-		"table",
+		"table", "year",
 	})
 
 	queryProcessedMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "stats_pipeline_exporter_queries_processed",
-		Help: "Queries processed for the current table",
+		Help: "Queries processed for the current export",
 	}, []string{
-		"table",
+		"table", "year",
 	})
 
 	inFlightUploadsHistogram = promauto.NewHistogramVec(
@@ -78,6 +97,13 @@ var (
 		[]string{"table"},
 	)
 
+	pathCollisionsMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_exporter_path_collisions_total",
+		Help: "Rows mapped to an output path already emitted in the same export",
+	}, []string{
+		"table", "year",
+	})
+
 	// Histogram bucket to record the upload queue size.
 	uploadQueueSizeHistogram = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -119,6 +145,24 @@ type JSONExporter struct {
 	queriesDone     int32
 	uploadQLen      int32
 	inflightUploads int32
+
+	// budget limits the bytes of marshalled files waiting to be uploaded,
+	// and limiter the queries running while uploads lag behind.
+	budget  *byteBudget
+	limiter *queryLimiter
+
+	// Output paths emitted during the current export, used to detect
+	// collisions. When merging collisions, pending holds the rows of every
+	// output path until all the queries are done.
+	collisionMode string
+	pathsMu       sync.Mutex
+	paths         map[string]bool
+	pending       map[string][]bqRow
+	collisions    int
+
+	// year is the year label of the metrics recorded during the current
+	// export.
+	year string
 }
 
 // UploadJob is a job for uploading data to a GCS bucket.
@@ -137,9 +181,11 @@ type UploadResult struct {
 // QueryJob is a job for running queries on BQ.
 type QueryJob struct {
 	name       string
+	shard      string
 	query      string
+	params     []bigquery.QueryParameter
 	fields     []string
-	outputPath *template.Template
+	outputPath *outputPathTemplate
 }
 
 // New creates a new JSONExporter.
@@ -149,6 +195,7 @@ func New(bqClient bqiface.Client, projectID string, output Writer, format Format
 		projectID: projectID,
 		output:    output,
 		format:    format,
+		budget:    sharedBudget(),
 
 		queryJobs:  make(chan *QueryJob),
 		uploadJobs: make(chan *UploadJob),
@@ -157,13 +204,9 @@ func New(bqClient bqiface.Client, projectID string, output Writer, format Format
 }
 
 // Formatter is the interface for all types that format table sources and
-// queries used during the export process.
-type Formatter interface {
-	Source(project string, config config.Config, year int) string
-	Partitions(source string) string
-	Partition(row map[string]bigquery.Value) string
-	Marshal(rows []map[string]bigquery.Value) ([]byte, error)
-}
+// queries used during the export process. It's defined in the formatter
+// package, so that the registered formatters implement it.
+type Formatter = formatter.Formatter
 
 // Export runs the provided SQL query and, for each row in the result, uploads
 // a file to the provided config.OutputPath on GCS. This file contains the JSON
@@ -178,36 +221,65 @@ type Formatter interface {
 // - 2020/output.json
 // - etc.
 //
+// The output path may transform the fields with the functions in pathFuncs,
+// e.g. "{{ .city | lower | escape }}/output.json". Files whose rendered path
+// is not a safe object name (see outputPathTemplate.Execute) are not uploaded.
+//
+// If incremental is true, only the files whose output path fields match rows
+// with config.DateField between period.Start and period.End are exported, and
+// only the partitions containing such rows are queried. This requires the
+// source table to have the partitioning field (shard) and config.DateField.
+//
+// If different files map to the same output path, e.g. because of an empty
+// field or because the export query is not sorted by the output path fields,
+// config.OutputCollisions selects what happens:
+//   - "report" (default): the collision is logged and counted, and the later
+//     file overwrites the earlier one.
+//   - "fail": the collision is logged and counted, the later file is not
+//     uploaded, and Export returns an error.
+//   - "merge": files are uploaded once all the queries are done, with the
+//     rows of all the files having the same output path.
+//
 // If any of the steps (running the query, reading the result, marshalling,
 // uploading) fails, this function returns the corresponding error.
 //
 // Note: config.OutputPath should not start with a "/".
 func (exporter *JSONExporter) Export(ctx context.Context,
 	config config.Config, queryTpl *template.Template,
-	year int) error {
+	period config.Period, incremental bool) (err error) {
+	ctx, span := startExportSpan(ctx, config, period, incremental)
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
 
-	// Retrieve list of fields from the output path template string.
-	fields, err := getFieldsFromPath(config.OutputPath)
-	if err != nil {
+	if err := checkCollisionMode(config.OutputCollisions); err != nil {
 		return err
 	}
-	log.Printf("Fields: %s", fields)
 
-	// Make output path template.
-	outputPath, err := template.New("outputPath").Parse(config.OutputPath)
+	// Make output path template and retrieve the list of fields it uses.
+	outputPath, err := parseOutputPath(config.OutputPath)
 	if err != nil {
 		return err
 	}
+	outputPath, err = outputPath.forPeriod(period)
+	if err != nil {
+		return err
+	}
+	fields := outputPath.fields
+	slog.DebugContext(ctx, "output path fields", "fields", fields)
 
-	// The fully qualified name for a table is project.dataset.table_year.
-	sourceTable := exporter.format.Source(exporter.projectID, config, year)
+	// The fully qualified name for a table is project.dataset.table_period.
+	sourceTable := exporter.format.Source(exporter.projectID, config, period)
 
-	// Generate WHERE clauses to shard the export query.
-	partitions, err := exporter.getPartitionsIDs(ctx, sourceTable)
+	sel, err := exporter.getExportPartitions(ctx, sourceTable, config.DateField,
+		fields, period, incremental)
 	if err != nil {
-		log.Print(err)
+		slog.ErrorContext(ctx, "cannot list partitions", "error", err)
 		return err
 	}
+	partitions := sel.partitions
+	span.SetAttributes(attribute.Int("partitions", len(partitions)))
 
 	// Create channels for query/upload jobs and results.
 	exporter.queryJobs = make(chan *QueryJob)
@@ -218,31 +290,32 @@ func (exporter *JSONExporter) Export(ctx context.Context,
 	exporter.uploadQLen = 0
 	exporter.inflightUploads = 0
 	exporter.queriesDone = 0
-
-	// Reset metrics for this table to zero.
-	resetMetrics(config.Table)
-	inFlightUploadsHistogram.Reset()
-	uploadQueueSizeHistogram.Reset()
-
-	// The number of queries to run is the same as the number of clauses
-	// generated earlier.
-	queryTotalMetric.WithLabelValues(config.Table).Set(float64(len(partitions)))
-
-	// Start a goroutine to print statistics periodically.
-	printStatsCtx, cancelPrintStats := context.WithCancel(ctx)
+	exporter.limiter = newQueryLimiter(config.Table, *nQueryWorkers,
+		exporter.budget)
+
+	// Forget the output paths emitted by previous exports.
+	exporter.collisionMode = config.OutputCollisions
+	exporter.paths = map[string]bool{}
+	exporter.pending = map[string][]bqRow{}
+	exporter.collisions = 0
+
+	// Reset the progress metrics for this table and year. The number of
+	// queries to run is the same as the number of clauses generated earlier.
+	exporter.year = strconv.Itoa(period.Start.Year())
+	resetProgressMetrics(config.Table, exporter.year, len(partitions))
+
+	// Start a goroutine to print statistics periodically. It reads the
+	// results until the results channel is closed, even if ctx is canceled,
+	// so that the workers sending results never block.
 	statsWg := sync.WaitGroup{}
 	statsWg.Add(1)
-	go exporter.printStats(printStatsCtx, &statsWg, len(partitions))
-	defer func() {
-		cancelPrintStats()
-		statsWg.Wait()
-	}()
+	go exporter.printStats(ctx, &statsWg, len(partitions))
+	defer statsWg.Wait()
 
 	queryWg := sync.WaitGroup{}
 	// Create queryWorkers.
 	for w := 1; w <= *nQueryWorkers; w++ {
 		queryWg.Add(1)
-		log.Printf("Created queryWorker with ID: %d\n", w)
 		go exporter.queryWorker(ctx, &queryWg)
 	}
 
@@ -258,47 +331,145 @@ func (exporter *JSONExporter) Export(ctx context.Context,
 	// terminated before terminating the upload workers. The second one makes
 	// sure all the upload workers have been terminated before returning.
 	// This makes sure close/wait are always called, and in the right order.
+	// Merged files are uploaded after all the query workers have terminated.
 	defer func() {
 		close(exporter.queryJobs)
 		queryWg.Wait()
+		exporter.uploadPending(ctx, config.Table)
 		close(exporter.uploadJobs)
 		uploadWg.Wait()
 		close(exporter.results)
+		// Files may have been skipped if ctx was canceled after all the
+		// queries were sent.
+		if err == nil && ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		if err == nil && exporter.collisionMode == failOnCollisions &&
+			exporter.collisions > 0 {
+			err = fmt.Errorf("%d output path collisions in %s",
+				exporter.collisions, config.Table)
+		}
 	}()
 
 	for _, v := range partitions {
-		// If the context has been canceled, stop sending jobs.
+		// If the context has been canceled, e.g. because the run has been
+		// cancelled or its byte budget is exceeded, stop sending jobs.
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return context.Cause(ctx)
 		}
 
 		// Execute the query template and send the query to one of the
 		// available queryWorker functions.
-		var buf bytes.Buffer
-		err = queryTpl.Execute(&buf, map[string]string{
-			"sourceTable": sourceTable,
-			"partitionID": v,
-			"project":     exporter.projectID,
-		})
+		query, params, err := exporter.partitionQuery(queryTpl, sourceTable,
+			period, sel, v)
 		if err != nil {
-			log.Print(err)
+			slog.ErrorContext(ctx, "cannot render export query", "error", err)
 			break
 		}
 
-		// Send a new QueryJob to the channel.
-		exporter.queryJobs <- &QueryJob{
+		// Send a new QueryJob to the channel, unless the context is canceled
+		// while waiting for a free queryWorker.
+		select {
+		case exporter.queryJobs <- &QueryJob{
 			name:       config.Table,
-			query:      buf.String(),
+			shard:      v,
+			query:      query,
+			params:     params,
 			fields:     fields,
 			outputPath: outputPath,
+		}:
+		case <-ctx.Done():
+			return context.Cause(ctx)
 		}
 		// Atomically increase the queriesDone counter and update metric.
 		atomic.AddInt32(&exporter.queriesDone, 1)
-		queryProcessedMetric.WithLabelValues(config.Table).Inc()
+		queryProcessedMetric.WithLabelValues(config.Table, exporter.year).Inc()
 	}
 	return nil
 }
 
+// checkCollisionMode returns an error if mode is not a valid value for
+// config.OutputCollisions.
+func checkCollisionMode(mode string) error {
+	switch mode {
+	case "", reportCollisions, failOnCollisions, mergeCollisions:
+		return nil
+	default:
+		return fmt.Errorf("invalid output collisions mode: %q", mode)
+	}
+}
+
+// partitionSelection is the set of partitions to export. In incremental mode,
+// keys holds for each partition the output path keys found in the period, and
+// only the rows having these keyFields values are exported.
+type partitionSelection struct {
+	partitions []string
+	keyFields  []string
+	keys       map[string][]string
+}
+
+// getExportPartitions generates the partition IDs used in WHERE clauses to
+// shard the export query. In incremental mode, only the partitions with rows
+// in the period are exported and each of them is restricted to the output
+// path keys found in the period.
+func (exporter *JSONExporter) getExportPartitions(ctx context.Context,
+	sourceTable, dateField string, fields []string, period config.Period,
+	incremental bool) (*partitionSelection, error) {
+	sel := &partitionSelection{}
+	var err error
+	if incremental {
+		sel.keyFields, err = exporter.getKeyFields(ctx, sourceTable, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sel.keyFields) > 0 {
+		sel.partitions, sel.keys, err = exporter.getIncrementalPartitions(ctx,
+			sourceTable, dateField, sel.keyFields, period)
+	} else {
+		if incremental {
+			slog.InfoContext(ctx,
+				"no output path fields, exporting all partitions",
+				"table", sourceTable)
+		}
+		sel.partitions, err = exporter.getPartitionsIDs(ctx, sourceTable, period)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sel, nil
+}
+
+// partitionQuery executes the export query template for a partition and
+// returns the query with its parameters. In incremental mode, the source is a
+// subquery only selecting rows whose output path keys have been found in the
+// period. The template can also use the period's periodParams.
+func (exporter *JSONExporter) partitionQuery(queryTpl *template.Template,
+	sourceTable string, period config.Period, sel *partitionSelection,
+	partition string) (string, []bigquery.QueryParameter, error) {
+	source := sourceTable
+	var params []bigquery.QueryParameter
+	if sel.keys != nil {
+		source = restrictedSource(sourceTable, sel.keyFields)
+		params = []bigquery.QueryParameter{
+			{
+				Name:  "keys",
+				Value: sel.keys[partition],
+			},
+		}
+	}
+	data := periodParams(period)
+	data["sourceTable"] = source
+	data["partitionID"] = partition
+	data["project"] = exporter.projectID
+	var buf bytes.Buffer
+	err := queryTpl.Execute(&buf, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return buf.String(), params, nil
+}
+
 // queryWorker reads the next available QueryJob from the queryJobs channel and
 // processes the result.
 func (exporter *JSONExporter) queryWorker(ctx context.Context,
@@ -308,44 +479,93 @@ func (exporter *JSONExporter) queryWorker(ctx context.Context,
 	defer wg.Done()
 
 	for j := range exporter.queryJobs {
-		// Run the SELECT query to get histogram data.
-		log.Printf("Running query: %s", j.query)
-		q := exporter.bqClient.Query(j.query)
-		job, err := q.Run(ctx)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		jobStatus, err := job.Wait(ctx)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		if jobStatus.Err() != nil {
-			log.Print(err)
+		// Wait until uploads have caught up enough to run another query.
+		if err := exporter.limiter.acquire(ctx); err != nil {
+			slog.ErrorContext(ctx, "cannot run query", "error", err)
 			continue
 		}
-		it, err := job.Read(ctx)
+		exporter.runQueryJob(ctx, j)
+		exporter.limiter.release()
+	}
+}
+
+// runQueryJob runs a QueryJob and processes the result. If a job running the
+// same query is still running, e.g. because a previous run has crashed, its
+// results are read instead of starting a new job.
+func (exporter *JSONExporter) runQueryJob(ctx context.Context, j *QueryJob) {
+	ctx, span := startQueryJobSpan(ctx, j)
+	defer span.End()
+	ctx = logging.With(ctx, "shard", j.shard)
+	prefix := jobIDPrefix("exports", j.name, j.query, j.params)
+	job, err := jobs.FindRunning(ctx, exporter.bqClient, prefix)
+	if err != nil {
+		// Not being able to list the jobs must not prevent the export.
+		slog.WarnContext(ctx, "cannot list running jobs", "error", err)
+	}
+	if job != nil {
+		slog.InfoContext(ctx, "reusing running query", "job_id", job.ID())
+	} else {
+		// Run the SELECT query to get histogram data.
+		slog.DebugContext(ctx, "running query", "query", j.query)
+		q := exporter.bqClient.Query(j.query)
+		qc := bqiface.QueryConfig{}
+		qc.Q = j.query
+		qc.Parameters = j.params
+		jobs.Configure(ctx, q, qc, prefix)
+		job, err = q.Run(ctx)
 		if err != nil {
-			log.Print(err)
-			continue
-		}
-		// Update bytes processed.
-		if queryDetails, ok := jobStatus.Statistics.Details.(*bigquery.QueryStatistics); ok {
-			if queryDetails.CacheHit {
-				cacheHitMetric.WithLabelValues(j.name).Inc()
-			}
-			bytesProcessedMetric.WithLabelValues(j.name).Add(float64(queryDetails.TotalBytesProcessed))
+			slog.ErrorContext(ctx, "cannot run query", "error", err)
+			tracing.SetError(span, err)
+			return
 		}
-		// Iterate over the returned rows and upload results to GCS.
-		err = exporter.processQueryResults(it, j)
-		if err != nil {
-			log.Print(err)
-			continue
+	}
+	ctx = logging.With(ctx, "job_id", job.ID())
+	jobStatus, err := jobs.Wait(ctx, job)
+	tracing.SetJob(span, job, jobStatus)
+	if err != nil {
+		slog.ErrorContext(ctx, "query failed", "error", err)
+		tracing.SetError(span, err)
+		return
+	}
+	if jobStatus.Err() != nil {
+		slog.ErrorContext(ctx, "query failed", "error", jobStatus.Err())
+		tracing.SetError(span, jobStatus.Err())
+		return
+	}
+	if err := jobs.Charge(ctx, jobStatus); err != nil {
+		slog.ErrorContext(ctx, "byte budget exceeded", "error", err)
+		tracing.SetError(span, err)
+		return
+	}
+	// Update bytes processed.
+	if queryDetails, ok := jobStatus.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		if queryDetails.CacheHit {
+			cacheHitMetric.WithLabelValues(j.name, exporter.year).Inc()
 		}
+		bytesProcessedMetric.WithLabelValues(j.name, exporter.year).Add(float64(queryDetails.TotalBytesProcessed))
+	}
+	// The results are read through the Storage Read API if enabled with
+	// EnableStorageRead.
+	it, err := job.Read(ctx)
+	if err == nil {
+		err = exporter.processRows(ctx, it, j)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot read query results", "error", err)
+		tracing.SetError(span, err)
 	}
 }
 
+// processRows iterates over the rows of a query's result and uploads the
+// resulting files, streaming them if possible.
+func (exporter *JSONExporter) processRows(ctx context.Context,
+	it bqiface.RowIterator, j *QueryJob) error {
+	if sw, sf, ok := exporter.canStream(); ok {
+		return exporter.streamQueryResults(ctx, it, j, sw, sf)
+	}
+	return exporter.processQueryResults(ctx, it, j)
+}
+
 // processQueryResults loops over a RowIterator.
 // For each row it generates a row key combining the fields in QueryJob.fields.
 // When the row key changes, it means a file containing the rows read so far
@@ -354,7 +574,8 @@ func (exporter *JSONExporter) queryWorker(ctx context.Context,
 //
 // For every UploadJob sent over the channel, it also atomically increments
 // uploadCounter.
-func (exporter *JSONExporter) processQueryResults(it bqiface.RowIterator,
+func (exporter *JSONExporter) processQueryResults(ctx context.Context,
+	it bqiface.RowIterator,
 	j *QueryJob) error {
 	var currentFile []bqRow
 	var lastRow bqRow
@@ -370,7 +591,7 @@ func (exporter *JSONExporter) processQueryResults(it bqiface.RowIterator,
 			for _, f := range j.fields {
 				if currentRow[f] != lastRow[f] {
 					// upload file, empty currentFile, break
-					exporter.uploadFile(j, currentFile, lastRow)
+					exporter.uploadFile(ctx, j, currentFile, lastRow)
 					currentFile = nil
 					break
 				}
@@ -393,7 +614,7 @@ func (exporter *JSONExporter) processQueryResults(it bqiface.RowIterator,
 
 	if err == iterator.Done {
 		// If this was the last row, upload the file so far.
-		exporter.uploadFile(j, currentFile, lastRow)
+		exporter.uploadFile(ctx, j, currentFile, lastRow)
 		// This is the expected behavior, so we don't consider this an error.
 		return nil
 	}
@@ -404,19 +625,87 @@ func (exporter *JSONExporter) processQueryResults(it bqiface.RowIterator,
 // uploadFile marshals the BigQuery rows and uploads the resulting JSON to the
 // GCS path defined in the QueryJob. Template variables are taken from the
 // first row in the slice.
-func (exporter *JSONExporter) uploadFile(j *QueryJob, rows []bqRow, lastRow bqRow) error {
+func (exporter *JSONExporter) uploadFile(ctx context.Context, j *QueryJob,
+	rows []bqRow, lastRow bqRow) error {
 	if len(rows) == 0 {
 		return errors.New("empty rows slice")
 	}
-	buf := new(bytes.Buffer)
 	// Use the first row to fill in the template variables.
-	err := j.outputPath.Execute(buf, lastRow)
+	objName, err := j.outputPath.Execute(lastRow)
 	if err != nil {
+		slog.ErrorContext(ctx, "cannot render output path", "error", err)
+		writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
 		return err
 	}
+	if !exporter.trackPath(ctx, j.name, objName, rows) {
+		return nil
+	}
 	atomic.AddInt32(&exporter.uploadQLen, 1)
-	exporter.marshalAndUpload(j.name, buf.String(), rows, exporter.uploadJobs)
-	return nil
+	err = exporter.marshalAndUpload(ctx, j.name, objName, rows,
+		exporter.uploadJobs)
+	if err != nil {
+		atomic.AddInt32(&exporter.uploadQLen, -1)
+		slog.ErrorContext(ctx, "cannot upload file", "path", objName,
+			"error", err)
+		writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+	}
+	return err
+}
+
+// trackPath records an output path emitted during the current export and
+// returns whether the file must be uploaded now, depending on the collision
+// mode. Collisions are logged and counted.
+func (exporter *JSONExporter) trackPath(ctx context.Context, table,
+	objName string, rows []bqRow) bool {
+	exporter.pathsMu.Lock()
+	defer exporter.pathsMu.Unlock()
+	if exporter.paths == nil {
+		exporter.paths = map[string]bool{}
+		exporter.pending = map[string][]bqRow{}
+	}
+	collision := exporter.paths[objName]
+	exporter.paths[objName] = true
+	if collision {
+		exporter.collisions++
+		pathCollisionsMetric.WithLabelValues(table, exporter.year).Inc()
+		slog.WarnContext(ctx, "output path collision", "table", table,
+			"path", objName)
+	}
+	switch exporter.collisionMode {
+	case mergeCollisions:
+		exporter.pending[objName] = append(exporter.pending[objName], rows...)
+		return false
+	case failOnCollisions:
+		return !collision
+	default:
+		return true
+	}
+}
+
+// uploadPending uploads the files held back when merging collisions, in
+// output path order.
+func (exporter *JSONExporter) uploadPending(ctx context.Context,
+	table string) {
+	exporter.pathsMu.Lock()
+	pending := exporter.pending
+	exporter.pending = map[string][]bqRow{}
+	exporter.pathsMu.Unlock()
+
+	objNames := make([]string, 0, len(pending))
+	for objName := range pending {
+		objNames = append(objNames, objName)
+	}
+	sort.Strings(objNames)
+	for _, objName := range objNames {
+		atomic.AddInt32(&exporter.uploadQLen, 1)
+		err := exporter.marshalAndUpload(ctx, table, objName,
+			pending[objName], exporter.uploadJobs)
+		if err != nil {
+			atomic.AddInt32(&exporter.uploadQLen, -1)
+			slog.ErrorContext(ctx, "cannot upload merged file",
+				"path", objName, "error", err)
+		}
+	}
 }
 
 // uploadWorker receives UploadJobs from the channel and uploads files to GCS.
@@ -437,11 +726,16 @@ func (exporter *JSONExporter) uploadWorker(ctx context.Context, wg *sync.WaitGro
 		atomic.AddInt32(&exporter.inflightUploads, 1)
 		inFlightUploadsHistogram.WithLabelValues(j.table).Observe(float64(
 			atomic.LoadInt32(&exporter.inflightUploads)))
-		err := exporter.output.Write(ctx, j.objName, j.content)
-		writtenFiles.WithLabelValues(j.table, fmt.Sprintf("%t", err == nil)).Inc()
+		uploadCtx, span := startUploadSpan(ctx, j.objName)
+		err := exporter.output.Write(uploadCtx, j.objName, j.content)
+		span.SetAttributes(attribute.Int("bytes", len(j.content)))
+		tracing.SetError(span, err)
+		span.End()
+		exporter.budget.release(int64(len(j.content)))
+		writtenFiles.WithLabelValues(j.table, exporter.year, fmt.Sprintf("%t", err == nil)).Inc()
 		atomic.AddInt32(&exporter.inflightUploads, -1)
 
-		uploadedBytesMetric.WithLabelValues(j.table).Add(float64(len(j.content)))
+		uploadedBytesMetric.WithLabelValues(j.table, exporter.year).Add(float64(len(j.content)))
 		exporter.results <- UploadResult{
 			objName: j.objName,
 			err:     err,
@@ -449,15 +743,19 @@ func (exporter *JSONExporter) uploadWorker(ctx context.Context, wg *sync.WaitGro
 	}
 }
 
-// getPartitionsIDs returns all partition IDs used by export queries to filter results.
+// getPartitionsIDs returns all partition IDs used by export queries to filter
+// results. The formatter may restrict them to the given period.
 func (exporter *JSONExporter) getPartitionsIDs(ctx context.Context,
-	fullyQualifiedTable string) ([]string, error) {
-	partitions := exporter.format.Partitions(fullyQualifiedTable)
-	log.Print(partitions)
+	fullyQualifiedTable string, period config.Period) ([]string, error) {
+	partitions := exporter.format.Partitions(fullyQualifiedTable, period)
+	slog.DebugContext(ctx, "listing partitions", "query", partitions)
 	q := exporter.bqClient.Query(partitions)
-	it, err := q.Read(ctx)
+	qc := bqiface.QueryConfig{}
+	qc.Q = partitions
+	jobs.Configure(ctx, q, qc, jobIDPrefix("partitions", fullyQualifiedTable,
+		partitions, nil))
+	it, err := readQuery(ctx, q)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 	// Generate the partition IDs from each row.
@@ -476,16 +774,128 @@ func (exporter *JSONExporter) getPartitionsIDs(ctx context.Context,
 	return partIDs, nil
 }
 
+// getKeyFields returns the output path fields that are columns of the source
+// table. Fields computed by the export query (e.g. year) are not returned.
+func (exporter *JSONExporter) getKeyFields(ctx context.Context,
+	fullyQualifiedTable string, fields []string) ([]string, error) {
+	parts := strings.Split(fullyQualifiedTable, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid source table: %s", fullyQualifiedTable)
+	}
+	md, err := exporter.bqClient.DatasetInProject(parts[0], parts[1]).
+		Table(parts[2]).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var keyFields []string
+	for _, f := range fields {
+		for _, col := range md.Schema {
+			if col.Name == f {
+				keyFields = append(keyFields, f)
+				break
+			}
+		}
+	}
+	return keyFields, nil
+}
+
+// getIncrementalPartitions returns the IDs of the partitions having rows with
+// dateField in the provided period, and for each partition ID the list of
+// output path keys found in the period. Keys are the JSON representation of
+// a STRUCT of keyFields, as generated by BigQuery's TO_JSON_STRING.
+func (exporter *JSONExporter) getIncrementalPartitions(ctx context.Context,
+	fullyQualifiedTable, dateField string, keyFields []string,
+	period config.Period) ([]string, map[string][]string, error) {
+	if dateField == "" {
+		return nil, nil, errors.New("incremental export requires a date field")
+	}
+	query := fmt.Sprintf(
+		`SELECT DISTINCT %s, TO_JSON_STRING(STRUCT(%s)) AS key
+		FROM `+"`%s`"+`
+		WHERE %s BETWEEN @startdate AND @enddate
+		ORDER BY %s`, partitionField, strings.Join(keyFields, ", "),
+		fullyQualifiedTable, dateField, partitionField)
+	slog.DebugContext(ctx, "listing incremental partitions", "query", query)
+	q := exporter.bqClient.Query(query)
+	qc := bqiface.QueryConfig{}
+	qc.Q = query
+	qc.Parameters = []bigquery.QueryParameter{
+		{
+			Name:  "startdate",
+			Value: period.Start.Format(dateFormat),
+		},
+		{
+			Name:  "enddate",
+			Value: period.End.Format(dateFormat),
+		},
+	}
+	jobs.Configure(ctx, q, qc, jobIDPrefix("partitions", fullyQualifiedTable,
+		query, qc.Parameters))
+	it, err := readQuery(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	var partIDs []string
+	keys := map[string][]string{}
+	for {
+		var row bqRow
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		id := exporter.format.Partition(row)
+		if _, ok := keys[id]; !ok {
+			partIDs = append(partIDs, id)
+		}
+		key, _ := row["key"].(string)
+		keys[id] = append(keys[id], key)
+	}
+	return partIDs, keys, nil
+}
+
+// readQuery runs a query, charging its bytes to the run's budget, and returns
+// an iterator over its results.
+func readQuery(ctx context.Context, q bqiface.Query) (bqiface.RowIterator,
+	error) {
+	job, _, err := jobs.Run(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return job.Read(ctx)
+}
+
+// jobIDPrefix returns the ID prefix of the BigQuery job running the given
+// query with the given parameters for the named table.
+func jobIDPrefix(kind, name, query string,
+	params []bigquery.QueryParameter) string {
+	return jobs.IDPrefix(kind, name, query, fmt.Sprint(params))
+}
+
+// restrictedSource returns a subquery selecting the rows of the source table
+// whose keyFields match one of the keys in the @keys query parameter.
+func restrictedSource(fullyQualifiedTable string, keyFields []string) string {
+	return fmt.Sprintf("(SELECT * FROM `%s` WHERE TO_JSON_STRING(STRUCT(%s)) IN UNNEST(@keys))",
+		fullyQualifiedTable, strings.Join(keyFields, ", "))
+}
+
 // marshalAndUpload marshals the BigQuery rows into a JSON array and sends a
 // new UploadJob to the uploadJobs channel so the result is uploaded to GCS as
 // objName.
-func (exporter *JSONExporter) marshalAndUpload(tableName, objName string, rows []bqRow,
-	uploadJobs chan<- *UploadJob) error {
+func (exporter *JSONExporter) marshalAndUpload(ctx context.Context, tableName,
+	objName string, rows []bqRow, uploadJobs chan<- *UploadJob) error {
 	j, err := exporter.format.Marshal(rows)
 	if err != nil {
 		return err
 	}
 
+	// Wait until the content fits in the byte budget. It is released once
+	// uploaded.
+	if err := exporter.budget.acquire(ctx, int64(len(j))); err != nil {
+		return err
+	}
 	uploadJobs <- &UploadJob{
 		table:   tableName,
 		objName: objName,
@@ -494,7 +904,8 @@ func (exporter *JSONExporter) marshalAndUpload(tableName, objName string, rows [
 	return nil
 }
 
-// printStats prints statistics about the ongoing export every second.
+// printStats prints statistics about the ongoing export every second, until
+// the results channel is closed.
 func (exporter *JSONExporter) printStats(ctx context.Context, wg *sync.WaitGroup,
 	totQueries int) {
 	// Send a signal to the main goroutine when the stats goroutine has finished.
@@ -505,43 +916,33 @@ func (exporter *JSONExporter) printStats(ctx context.Context, wg *sync.WaitGroup
 	errors := 0
 	start := time.Now()
 
-	// Keep printing stats every second until the context is canceled.
+	// Keep printing stats every second until all the results have been read.
 	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
 	for {
 		select {
-		case <-ctx.Done():
-			return
-		case res := <-exporter.results:
+		case res, ok := <-exporter.results:
+			if !ok {
+				return
+			}
 			if res.err != nil {
 				errors++
 			} else {
 				uploaded++
 			}
 		case <-t.C:
-			log.Printf(
-				"Elapsed: %s, queries: %d/%d, uploaded: %d (%d errors), files/s: %f, UL queue: %d",
-				time.Since(start).Round(time.Second).String(),
-				atomic.LoadInt32(&exporter.queriesDone), totQueries, uploaded, errors,
-				float64(uploaded)/time.Since(start).Seconds(),
-				atomic.LoadInt32(&exporter.uploadQLen))
+			slog.InfoContext(ctx, "export progress",
+				"elapsed", time.Since(start).Round(time.Second).String(),
+				"queries", atomic.LoadInt32(&exporter.queriesDone),
+				"total_queries", totQueries,
+				"uploaded", uploaded,
+				"errors", errors,
+				"files_per_second", float64(uploaded)/time.Since(start).Seconds(),
+				"upload_queue", atomic.LoadInt32(&exporter.uploadQLen))
 		}
 	}
 }
 
-// getFieldsFromPath takes the outputPath template string and returns the
-// fields matched by the capture group in fieldRegex.
-func getFieldsFromPath(path string) ([]string, error) {
-	var fields []string
-	matches := fieldRegex.FindAllStringSubmatch(path, -1)
-	if len(matches) == 0 {
-		return nil, errors.New("no fields found in the path template")
-	}
-	for _, m := range matches {
-		fields = append(fields, m[1])
-	}
-	return fields, nil
-}
-
 // removeFieldsFromRow returns a new BQ row without the specified fields. It
 // also removes the partitioning field if present.
 func removeFieldsFromRow(row bqRow, fields []string) bqRow {
@@ -560,10 +961,9 @@ func removeFieldsFromRow(row bqRow, fields []string) bqRow {
 	return newRow
 }
 
-// resetMetrics sets all the metrics for a given table to zero.
-func resetMetrics(tableName string) {
-	queryProcessedMetric.WithLabelValues(tableName).Set(0)
-	uploadedBytesMetric.WithLabelValues(tableName).Set(0)
-	bytesProcessedMetric.WithLabelValues(tableName).Set(0)
-	cacheHitMetric.WithLabelValues(tableName).Set(0)
+// resetProgressMetrics resets the progress metrics of an export of the given
+// table and year, leaving the other tables and years untouched.
+func resetProgressMetrics(tableName, year string, queries int) {
+	queryTotalMetric.WithLabelValues(tableName, year).Set(float64(queries))
+	queryProcessedMetric.WithLabelValues(tableName, year).Set(0)
 }
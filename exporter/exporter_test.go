@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -19,8 +21,9 @@ import (
 	"github.com/m-lab/go/cloudtest/gcsfake"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/go/testingx"
-	"github.com/m-lab/go/uploader"
+	"github.com/m-lab/stats-pipeline/config"
 	"github.com/m-lab/stats-pipeline/formatter"
+	"github.com/m-lab/stats-pipeline/jobs"
 	"github.com/m-lab/stats-pipeline/output"
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/api/iterator"
@@ -31,52 +34,102 @@ import (
 type mockClient struct {
 	bqiface.Client
 
-	// queryReadMustFail controls whether the Read() method will fail for
-	// queries created by this client object.
-	queryReadMustFail bool
-
 	// queries stores every query run through this client so it can be
 	// checked later in tests.
 	queries []string
 
-	// iterator is the fake iterator every query will return.
+	// iterator is the fake iterator every partitions listing will return.
 	// Allows to provide fake query results.
 	iterator bqiface.RowIterator
+
+	// schema is the schema returned by every table's Metadata().
+	schema bigquery.Schema
+
+	// started receives the query of every export job run through this
+	// client. The jobs run until their context is canceled. If started is
+	// nil, the jobs are done immediately and their results are jobRows.
+	// Partitions listings are always done immediately.
+	started chan string
+	jobRows []map[string]bigquery.Value
+	// cancelled is the number of jobs canceled.
+	cancelled int
+
+	// running are the jobs listed by Jobs(), or jobsErr its error.
+	running []bqiface.Job
+	jobsErr error
 }
 
 func (c *mockClient) Dataset(name string) bqiface.Dataset {
 	return &mockDataset{
-		name: name,
+		name:   name,
+		schema: c.schema,
 	}
 }
 
+func (c *mockClient) DatasetInProject(project, name string) bqiface.Dataset {
+	return c.Dataset(name)
+}
+
+func (c *mockClient) Jobs(context.Context) bqiface.JobIterator {
+	return &mockJobIterator{jobs: c.running, err: c.jobsErr}
+}
+
 func (c *mockClient) Query(query string) bqiface.Query {
 	return &mockQuery{
-		client:       c,
-		q:            query,
-		readMustFail: c.queryReadMustFail,
-		iterator:     c.iterator,
+		client:   c,
+		q:        query,
+		iterator: c.iterator,
+	}
+}
+
+// ***** mockJobIterator *****
+type mockJobIterator struct {
+	bqiface.JobIterator
+	jobs []bqiface.Job
+	err  error
+}
+
+func (it *mockJobIterator) SetState(bigquery.State) {}
+
+func (it *mockJobIterator) Next() (bqiface.Job, error) {
+	if it.err != nil {
+		return nil, it.err
 	}
+	if len(it.jobs) == 0 {
+		return nil, iterator.Done
+	}
+	job := it.jobs[0]
+	it.jobs = it.jobs[1:]
+	return job, nil
 }
 
 // ***** mockDataset *****
 type mockDataset struct {
 	bqiface.Dataset
-	name string
+	name   string
+	schema bigquery.Schema
 }
 
 func (ds *mockDataset) Table(name string) bqiface.Table {
 	return &mockTable{
-		ds:   ds.name,
-		name: name,
+		ds:     ds.name,
+		name:   name,
+		schema: ds.schema,
 	}
 }
 
 // ***** mockTable *****
 type mockTable struct {
 	bqiface.Table
-	ds   string
-	name string
+	ds     string
+	name   string
+	schema bigquery.Schema
+}
+
+func (t *mockTable) Metadata(context.Context) (*bigquery.TableMetadata, error) {
+	return &bigquery.TableMetadata{
+		Schema: t.schema,
+	}, nil
 }
 
 func (t *mockTable) DatasetID() string {
@@ -90,27 +143,91 @@ func (t *mockTable) TableID() string {
 // ********** mockQuery **********
 type mockQuery struct {
 	bqiface.Query
-	client       *mockClient
-	q            string
-	qc           bqiface.QueryConfig
-	readMustFail bool
-	runMustFail  bool
-	iterator     bqiface.RowIterator
+	client      *mockClient
+	q           string
+	qc          bqiface.QueryConfig
+	runMustFail bool
+	iterator    bqiface.RowIterator
+	jobIDConfig bigquery.JobIDConfig
 }
 
-func (q *mockQuery) Read(context.Context) (bqiface.RowIterator, error) {
-	if q.readMustFail {
-		return nil, errors.New("Read() failed")
+func (q *mockQuery) Run(context.Context) (bqiface.Job, error) {
+	if q.runMustFail {
+		return nil, errors.New("Run() failed")
 	}
 	// Store the query's content into the client so it can be checked later.
 	q.client.queries = append(q.client.queries, q.q)
-	return q.iterator, nil
+	if strings.HasPrefix(q.jobIDConfig.JobID, "stats_partitions_") {
+		return &doneJob{iterator: q.iterator}, nil
+	}
+	if q.client.started == nil {
+		return &doneJob{
+			iterator: &mockRowIterator{rows: q.client.jobRows},
+		}, nil
+	}
+	q.client.started <- q.q
+	return &runningJob{client: q.client}, nil
 }
 
 func (q *mockQuery) SetQueryConfig(qc bqiface.QueryConfig) {
 	q.qc = qc
 }
 
+func (q *mockQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobIDConfig
+}
+
+// ***** runningJob *****
+type runningJob struct {
+	bqiface.Job
+	client *mockClient
+}
+
+func (j *runningJob) ID() string {
+	return "job-id"
+}
+
+func (j *runningJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (j *runningJob) Cancel(context.Context) error {
+	j.client.cancelled++
+	return nil
+}
+
+// ***** doneJob *****
+type doneJob struct {
+	bqiface.Job
+	id       string
+	iterator bqiface.RowIterator
+}
+
+func (j *doneJob) ID() string {
+	if j.id != "" {
+		return j.id
+	}
+	return "job-id"
+}
+
+func (j *doneJob) LastStatus() *bigquery.JobStatus {
+	return nil
+}
+
+func (j *doneJob) Wait(context.Context) (*bigquery.JobStatus, error) {
+	return &bigquery.JobStatus{
+		State: bigquery.Done,
+		Statistics: &bigquery.JobStatistics{
+			TotalBytesProcessed: 10,
+		},
+	}, nil
+}
+
+func (j *doneJob) Read(context.Context) (bqiface.RowIterator, error) {
+	return j.iterator, nil
+}
+
 // ***** mockRowIterator *****
 type mockRowIterator struct {
 	bqiface.RowIterator
@@ -158,11 +275,23 @@ func (writer *mockWriter) Write(ctx context.Context, path string, content []byte
 	return nil
 }
 
+// cancellingWriter cancels the export's context when writing a file, e.g. as
+// if the run were cancelled during an upload.
+type cancellingWriter struct {
+	cancel context.CancelCauseFunc
+	cause  error
+}
+
+func (w *cancellingWriter) Write(context.Context, string, []byte) error {
+	w.cancel(w.cause)
+	return nil
+}
+
 func TestNew(t *testing.T) {
 	bq, err := bqfake.NewClient(context.Background(), "test", map[string]*bqfake.Dataset{})
 	testingx.Must(t, err, "cannot init bq client")
 	gcs := &gcsfake.GCSClient{}
-	wr := output.NewGCSWriter(uploader.New(gcs, "test-bucket"))
+	wr := output.NewGCSWriter(gcs, "test-bucket")
 	f := formatter.NewStatsQueryFormatter()
 	exporter := New(bq, "project", wr, f)
 	if exporter == nil {
@@ -184,7 +313,7 @@ func TestJSONExporter_marshalAndUpload(t *testing.T) {
 	}
 	rows := []bqRow{fakeRow}
 	go func() {
-		err := exporter.marshalAndUpload("tablename", "test", rows, jobs)
+		err := exporter.marshalAndUpload(context.Background(), "tablename", "test", rows, jobs)
 		if err != nil {
 			t.Errorf("marshalAndUpload() returned err: %v", err)
 		}
@@ -207,7 +336,7 @@ func TestJSONExporter_marshalAndUpload(t *testing.T) {
 	rows = append(rows, unmarshallableRow)
 	jobs = make(chan *UploadJob)
 	go func() {
-		err := exporter.marshalAndUpload("tablename", "this-will-fail", rows, jobs)
+		err := exporter.marshalAndUpload(context.Background(), "tablename", "this-will-fail", rows, jobs)
 		if err == nil {
 			t.Errorf("marshalAndUpload(): expected error, got nil")
 		}
@@ -221,14 +350,15 @@ func TestJSONExporter_marshalAndUpload(t *testing.T) {
 
 func Test_printStats(t *testing.T) {
 	out := new(bytes.Buffer)
-	log.SetOutput(out)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, nil)))
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	bq, err := bqfake.NewClient(context.Background(), "test", map[string]*bqfake.Dataset{})
 	testingx.Must(t, err, "cannot init bq client")
 	gcs := &gcsfake.GCSClient{}
-	wr := output.NewGCSWriter(uploader.New(gcs, "test-bucket"))
+	wr := output.NewGCSWriter(gcs, "test-bucket")
 	f := formatter.NewStatsQueryFormatter()
 	exporter := New(bq, "project", wr, f)
 
@@ -247,46 +377,14 @@ func Test_printStats(t *testing.T) {
 
 	// Make sure we had enough time to print the stats at least once.
 	time.Sleep(2 * time.Second)
-	cancel()
+	close(exporter.results)
 	wg.Wait()
-	if !strings.Contains(out.String(), "uploaded: 1") ||
-		!strings.Contains(out.String(), "1 errors") {
+	if !strings.Contains(out.String(), "uploaded=1") ||
+		!strings.Contains(out.String(), "errors=1") {
 		t.Errorf("printStats() didn't print the expected output: %v", out.String())
 	}
 }
 
-func Test_getFieldsFromPath(t *testing.T) {
-	tests := []struct {
-		name    string
-		path    string
-		want    []string
-		wantErr bool
-	}{
-		{
-			name: "ok",
-			path: "{{ .foo }}/{{.bar}}",
-			want: []string{"foo", "bar"},
-		},
-		{
-			name:    "no-matches",
-			path:    "{{foo}}/{{bar}}",
-			want:    nil,
-			wantErr: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := getFieldsFromPath(tt.path)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("getFieldsFromPath() = %v, want %v", got, tt.want)
-			}
-			if (err != nil) != tt.wantErr {
-				t.Errorf("exporter.getFieldsFromPath() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
-
 func Test_removeFieldsFromRow(t *testing.T) {
 	fakeRow := bqRow{
 		"test":   "foo",
@@ -324,13 +422,16 @@ func Test_removeFieldsFromRow(t *testing.T) {
 
 // TestPrometheusMetrics ensures that all the metrics pass the linter.
 func TestPrometheusMetrics(t *testing.T) {
-	bytesProcessedMetric.WithLabelValues("x")
-	cacheHitMetric.WithLabelValues("x")
-	uploadedBytesMetric.WithLabelValues("x")
-	queryTotalMetric.WithLabelValues("x")
-	queryProcessedMetric.WithLabelValues("x")
+	bytesProcessedMetric.WithLabelValues("x", "x")
+	cacheHitMetric.WithLabelValues("x", "x")
+	uploadedBytesMetric.WithLabelValues("x", "x")
+	writtenFiles.WithLabelValues("x", "x", "x")
+	queryTotalMetric.WithLabelValues("x", "x")
+	queryProcessedMetric.WithLabelValues("x", "x")
 	inFlightUploadsHistogram.WithLabelValues("x")
 	uploadQueueSizeHistogram.WithLabelValues("x")
+	pathCollisionsMetric.WithLabelValues("x", "x")
+	queryConcurrencyMetric.WithLabelValues("x")
 
 	promtest.LintMetrics(t)
 }
@@ -350,20 +451,21 @@ func TestJSONExporter_processQueryResults(t *testing.T) {
 			},
 		},
 	}
-	outputPathTpl := template.Must(template.New("path").Parse(
-		"{{.year}}/output.json",
-	))
+	outputPathTpl, err := parseOutputPath("{{.year}}/output.json")
+	if err != nil {
+		t.Fatalf("parseOutputPath() returned err: %v", err)
+	}
 	qJob := &QueryJob{
 		name:       "test",
 		query:      "SELECT * FROM test_table",
 		fields:     []string{"year"},
 		outputPath: outputPathTpl,
 	}
-	go exporter.processQueryResults(it, qJob)
+	go exporter.processQueryResults(context.Background(), it, qJob)
 	// Read the job sent on the uploadJobs channel and check its content.
 	ul := <-exporter.uploadJobs
 	var rows []map[string]json.RawMessage
-	err := json.Unmarshal(ul.content, &rows)
+	err = json.Unmarshal(ul.content, &rows)
 	if err != nil {
 		t.Errorf("Cannot unmarshal JSON: %v", err)
 	}
@@ -383,31 +485,194 @@ func TestJSONExporter_processQueryResults(t *testing.T) {
 	}
 }
 
-func Test_resetMetrics(t *testing.T) {
-	const table = "test"
-
-	// Set all the metrics to 1.
-	queryProcessedMetric.WithLabelValues(table).Set(1)
-	uploadedBytesMetric.WithLabelValues(table).Set(1)
-	bytesProcessedMetric.WithLabelValues(table).Set(1)
-	cacheHitMetric.WithLabelValues(table).Set(1)
-
-	// Reset the metrics.
-	resetMetrics(table)
-
-	// Write the metrics to a map and check that they are all 0.
-	metrics := map[string]*dto.Metric{}
-	metrics["query_processed"] = &dto.Metric{}
-	metrics["uploaded_bytes"] = &dto.Metric{}
-	metrics["bytes_processed"] = &dto.Metric{}
-	metrics["cache_hit"] = &dto.Metric{}
-	queryProcessedMetric.WithLabelValues(table).Write(metrics["query_processed"])
-	uploadedBytesMetric.WithLabelValues(table).Write(metrics["uploaded_bytes"])
-	bytesProcessedMetric.WithLabelValues(table).Write(metrics["bytes_processed"])
-	cacheHitMetric.WithLabelValues(table).Write(metrics["cache_hit"])
-	for _, v := range metrics {
-		if v.Gauge.GetValue() != 0 {
-			t.Errorf("metric is not 0: %v", v)
+func TestJSONExporter_runQueryJob_reuse(t *testing.T) {
+	outputPath, err := parseOutputPath("{{ .year }}/output.json")
+	if err != nil {
+		t.Fatalf("parseOutputPath() returned err: %v", err)
+	}
+	j := &QueryJob{
+		name:       "table",
+		shard:      "1",
+		query:      "SELECT * FROM table WHERE shard = 1",
+		fields:     outputPath.fields,
+		outputPath: outputPath,
+	}
+	rows := []map[string]bigquery.Value{{"year": int64(2020), "value": 1}}
+	prefix := jobIDPrefix("exports", j.name, j.query, j.params)
+	tests := []struct {
+		name        string
+		client      *mockClient
+		wantQueries int
+	}{
+		{
+			name: "running-job",
+			client: &mockClient{
+				running: []bqiface.Job{
+					&doneJob{id: "other-job"},
+					&doneJob{
+						id:       prefix + "-abc",
+						iterator: &mockRowIterator{rows: rows},
+					},
+				},
+			},
+		},
+		{
+			name: "other-running-job",
+			client: &mockClient{
+				running: []bqiface.Job{&doneJob{id: "other-job"}},
+				jobRows: rows,
+			},
+			wantQueries: 1,
+		},
+		{
+			name: "list-failure",
+			client: &mockClient{
+				jobsErr: errors.New("Jobs() failed"),
+				jobRows: rows,
+			},
+			wantQueries: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := New(tt.client, "project", &mockWriter{mu: &sync.Mutex{}},
+				formatter.NewStatsQueryFormatter())
+			exporter.paths = map[string]bool{}
+			var uploaded []string
+			done := make(chan bool)
+			go func() {
+				for u := range exporter.uploadJobs {
+					uploaded = append(uploaded, u.objName)
+					exporter.budget.release(int64(len(u.content)))
+				}
+				done <- true
+			}()
+			exporter.runQueryJob(context.Background(), j)
+			close(exporter.uploadJobs)
+			<-done
+			if len(tt.client.queries) != tt.wantQueries {
+				t.Errorf("runQueryJob() ran %v, want %d queries",
+					tt.client.queries, tt.wantQueries)
+			}
+			if !reflect.DeepEqual(uploaded, []string{"2020/output.json"}) {
+				t.Errorf("runQueryJob() uploaded %v", uploaded)
+			}
+		})
+	}
+}
+
+func TestJSONExporter_trackPath(t *testing.T) {
+	rows := []bqRow{{"a": 1}}
+	tests := []struct {
+		name           string
+		mode           string
+		want           []bool
+		wantCollisions int
+		wantPending    int
+	}{
+		{
+			name:           "report",
+			mode:           "",
+			want:           []bool{true, true, true},
+			wantCollisions: 1,
+		},
+		{
+			name:           "fail",
+			mode:           failOnCollisions,
+			want:           []bool{true, true, false},
+			wantCollisions: 1,
+		},
+		{
+			name:           "merge",
+			mode:           mergeCollisions,
+			want:           []bool{false, false, false},
+			wantCollisions: 1,
+			wantPending:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := &JSONExporter{
+				collisionMode: tt.mode,
+			}
+			var got []bool
+			for _, objName := range []string{"a.json", "b.json", "a.json"} {
+				got = append(got, exporter.trackPath(context.Background(), "table", objName, rows))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trackPath() = %v, want %v", got, tt.want)
+			}
+			if exporter.collisions != tt.wantCollisions {
+				t.Errorf("trackPath() counted %d collisions, want %d",
+					exporter.collisions, tt.wantCollisions)
+			}
+			if len(exporter.pending) != tt.wantPending {
+				t.Errorf("trackPath() kept %d pending files, want %d",
+					len(exporter.pending), tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestJSONExporter_uploadPending(t *testing.T) {
+	exporter := &JSONExporter{
+		uploadJobs:    make(chan *UploadJob),
+		format:        formatter.NewStatsQueryFormatter(),
+		collisionMode: mergeCollisions,
+	}
+	exporter.trackPath(context.Background(), "table", "b.json", []bqRow{{"n": 1}})
+	exporter.trackPath(context.Background(), "table", "a.json", []bqRow{{"n": 2}})
+	exporter.trackPath(context.Background(), "table", "b.json", []bqRow{{"n": 3}})
+	go func() {
+		exporter.uploadPending(context.Background(), "table")
+		close(exporter.uploadJobs)
+	}()
+	var got []string
+	for j := range exporter.uploadJobs {
+		got = append(got, j.objName+" "+string(j.content))
+	}
+	want := []string{
+		`a.json [{"n":2}]`,
+		`b.json [{"n":1},{"n":3}]`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploadPending() uploaded %v, want %v", got, want)
+	}
+	if len(exporter.pending) != 0 {
+		t.Errorf("uploadPending() didn't clear the pending files")
+	}
+}
+
+func Test_resetProgressMetrics(t *testing.T) {
+	// Set all the metrics for two tables and two years to 1.
+	for _, table := range []string{"test", "other"} {
+		for _, year := range []string{"2020", "2021"} {
+			queryTotalMetric.WithLabelValues(table, year).Set(1)
+			queryProcessedMetric.WithLabelValues(table, year).Set(1)
+		}
+	}
+
+	// Reset the metrics for a single table and year.
+	resetProgressMetrics("test", "2020", 10)
+
+	// Write the metrics to a map and check that only this table and year
+	// have been reset.
+	for _, table := range []string{"test", "other"} {
+		for _, year := range []string{"2020", "2021"} {
+			total := &dto.Metric{}
+			processed := &dto.Metric{}
+			queryTotalMetric.WithLabelValues(table, year).Write(total)
+			queryProcessedMetric.WithLabelValues(table, year).Write(processed)
+			wantTotal, wantProcessed := 1.0, 1.0
+			if table == "test" && year == "2020" {
+				wantTotal, wantProcessed = 10, 0
+			}
+			if total.Gauge.GetValue() != wantTotal ||
+				processed.Gauge.GetValue() != wantProcessed {
+				t.Errorf("%s %s: got %v/%v queries, want %v/%v", table, year,
+					processed.Gauge.GetValue(), total.Gauge.GetValue(),
+					wantProcessed, wantTotal)
+			}
 		}
 	}
 }
@@ -510,3 +775,311 @@ func TestJSONExporter_uploadWorkerCancellation(t *testing.T) {
 
 	close(exporter.results)
 }
+
+func TestJSONExporter_ExportCancellation(t *testing.T) {
+	// With a single queryWorker, the second QueryJob can only be sent once
+	// the first one is done, i.e. after the context has been canceled.
+	oldWorkers := *nQueryWorkers
+	*nQueryWorkers = 1
+	defer func() { *nQueryWorkers = oldWorkers }()
+
+	mc := &mockClient{
+		iterator: &mockRowIterator{
+			rows: []map[string]bigquery.Value{
+				{"shard": int64(1)}, {"shard": int64(2)}, {"shard": int64(3)},
+			},
+		},
+		started: make(chan string),
+	}
+	exporter := New(mc, "project", &mockWriter{mu: &sync.Mutex{}},
+		formatter.NewStatsQueryFormatter())
+	period, err := config.PeriodOf(time.Date(2020, 1, 1, 0, 0, 0, 0,
+		time.UTC), config.Yearly)
+	if err != nil {
+		t.Fatalf("PeriodOf() returned err: %v", err)
+	}
+	tpl := template.Must(template.New("query").Parse(
+		"SELECT * FROM {{ .sourceTable }} WHERE shard = {{ .partitionID }}"))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("cancelled")
+	go func() {
+		// Cancel the export once the first query is running.
+		<-mc.started
+		cancel(cause)
+	}()
+	err = exporter.Export(ctx, config.Config{
+		Dataset:    "dataset",
+		Table:      "table",
+		OutputPath: "{{ .year }}/output.json",
+	}, tpl, period, false)
+	if !errors.Is(err, cause) {
+		t.Errorf("Export() returned %v, want %v", err, cause)
+	}
+	// The queries are the partitions' listing and the first QueryJob.
+	if len(mc.queries) != 2 {
+		t.Errorf("Export() ran %d queries, want 2: %v", len(mc.queries),
+			mc.queries)
+	}
+	if mc.cancelled != 1 {
+		t.Errorf("Export() canceled %d jobs, want 1", mc.cancelled)
+	}
+}
+
+func TestJSONExporter_ExportCancellationDuringUpload(t *testing.T) {
+	// The context is canceled while the upload worker still has to send
+	// the upload's result: Export must not wait for it forever.
+	mc := &mockClient{
+		iterator: &mockRowIterator{
+			rows: []map[string]bigquery.Value{{"shard": int64(1)}},
+		},
+		jobRows: []map[string]bigquery.Value{
+			{"year": int64(2020), "value": int64(1)},
+		},
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	cause := errors.New("cancelled")
+	exporter := New(mc, "project", &cancellingWriter{cancel: cancel,
+		cause: cause}, formatter.NewStatsQueryFormatter())
+	period, err := config.PeriodOf(time.Date(2020, 1, 1, 0, 0, 0, 0,
+		time.UTC), config.Yearly)
+	if err != nil {
+		t.Fatalf("PeriodOf() returned err: %v", err)
+	}
+	tpl := template.Must(template.New("query").Parse(
+		"SELECT * FROM {{ .sourceTable }} WHERE shard = {{ .partitionID }}"))
+
+	done := make(chan error)
+	go func() {
+		done <- exporter.Export(ctx, config.Config{
+			Dataset:    "dataset",
+			Table:      "table",
+			OutputPath: "{{ .year }}/output.json",
+		}, tpl, period, false)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Export() didn't return after the context was canceled")
+	}
+	if !errors.Is(context.Cause(ctx), cause) {
+		t.Errorf("the upload didn't cancel the context")
+	}
+}
+
+func TestJSONExporter_ExportCancellationOnFullBudget(t *testing.T) {
+	// The file waits for room in a full byte budget: canceling the
+	// context must stop the wait.
+	mc := &mockClient{
+		iterator: &mockRowIterator{
+			rows: []map[string]bigquery.Value{{"shard": int64(1)}},
+		},
+		jobRows: []map[string]bigquery.Value{
+			{"year": int64(2020), "value": int64(1)},
+		},
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	exporter := New(mc, "project", &mockWriter{},
+		formatter.NewStatsQueryFormatter())
+	exporter.budget = newByteBudget(1)
+	if err := exporter.budget.acquire(ctx, 1); err != nil {
+		t.Fatalf("acquire() returned err: %v", err)
+	}
+	period, err := config.PeriodOf(time.Date(2020, 1, 1, 0, 0, 0, 0,
+		time.UTC), config.Yearly)
+	if err != nil {
+		t.Fatalf("PeriodOf() returned err: %v", err)
+	}
+	tpl := template.Must(template.New("query").Parse(
+		"SELECT * FROM {{ .sourceTable }} WHERE shard = {{ .partitionID }}"))
+
+	cause := errors.New("cancelled")
+	time.AfterFunc(100*time.Millisecond, func() { cancel(cause) })
+	done := make(chan error)
+	go func() {
+		done <- exporter.Export(ctx, config.Config{
+			Dataset:    "dataset",
+			Table:      "table",
+			OutputPath: "{{ .year }}/output.json",
+		}, tpl, period, false)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, cause) {
+			t.Errorf("Export() error = %v, want %v", err, cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Export() didn't return after the context was canceled")
+	}
+}
+
+func TestJSONExporter_ExportMonthlyPeriods(t *testing.T) {
+	tests := []struct {
+		name       string
+		outputPath string
+		wantFiles  []string
+		wantErr    bool
+	}{
+		{
+			name:       "period",
+			outputPath: "v0/{{ .continent_code }}/{{ .period }}/stats.json",
+			wantFiles: []string{
+				"v0/EU/2020_01/stats.json",
+				"v0/EU/2020_02/stats.json",
+				"v0/EU/2020_03/stats.json",
+			},
+		},
+		{
+			name:       "no-period",
+			outputPath: "v0/{{ .continent_code }}/{{ .year }}/stats.json",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partitions := &mockRowIterator{
+				rows: []map[string]bigquery.Value{{"shard": int64(1)}},
+			}
+			mc := &mockClient{
+				iterator: partitions,
+				jobRows: []map[string]bigquery.Value{
+					{"continent_code": "EU", "year": int64(2020)},
+				},
+			}
+			w := &mapWriter{files: map[string]string{}}
+			exporter := New(mc, "project", w, formatter.NewStatsQueryFormatter())
+			tpl := template.Must(template.New("query").Parse(
+				"SELECT * FROM {{ .sourceTable }} WHERE shard = {{ .partitionID }} " +
+					"AND date BETWEEN '{{ .periodStart }}' AND '{{ .periodEnd }}'"))
+			var wantQueries []string
+			for month := time.January; month <= time.March; month++ {
+				period, err := config.PeriodOf(time.Date(2020, month, 1, 0, 0,
+					0, 0, time.UTC), config.Monthly)
+				if err != nil {
+					t.Fatalf("PeriodOf() returned err: %v", err)
+				}
+				partitions.Reset()
+				err = exporter.Export(context.Background(), config.Config{
+					Dataset:    "dataset",
+					Table:      "table",
+					Period:     config.Monthly,
+					OutputPath: tt.outputPath,
+				}, tpl, period, false)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Export() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				wantQueries = append(wantQueries, fmt.Sprintf(
+					"SELECT * FROM project.dataset.table_%s WHERE shard = 1 "+
+						"AND date BETWEEN '%s' AND '%s'", period.Suffix(),
+					period.Start.Format(dateFormat), period.End.Format(dateFormat)))
+			}
+			if tt.wantErr {
+				return
+			}
+			var files []string
+			for f := range w.files {
+				files = append(files, f)
+			}
+			sort.Strings(files)
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("Export() wrote %v, want %v", files, tt.wantFiles)
+			}
+			var queries []string
+			for _, q := range mc.queries {
+				if strings.HasPrefix(q, "SELECT * FROM project.") {
+					queries = append(queries, q)
+				}
+			}
+			if !reflect.DeepEqual(queries, wantQueries) {
+				t.Errorf("Export() ran %q, want %q", queries, wantQueries)
+			}
+		})
+	}
+}
+
+func TestJSONExporter_getKeyFields(t *testing.T) {
+	exporter := &JSONExporter{
+		bqClient: &mockClient{
+			schema: bigquery.Schema{
+				{Name: "date"},
+				{Name: "continent_code"},
+				{Name: "shard"},
+			},
+		},
+	}
+	got, err := exporter.getKeyFields(context.Background(),
+		"project.dataset.table", []string{"continent_code", "year"})
+	if err != nil {
+		t.Fatalf("getKeyFields() returned err: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"continent_code"}) {
+		t.Errorf("getKeyFields() = %v, want [continent_code]", got)
+	}
+
+	_, err = exporter.getKeyFields(context.Background(), "invalid",
+		[]string{"year"})
+	if err == nil {
+		t.Errorf("getKeyFields(): expected err, got nil")
+	}
+}
+
+func TestJSONExporter_getIncrementalPartitions(t *testing.T) {
+	period := config.Period{
+		Start: time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2021, time.March, 2, 0, 0, 0, 0, time.UTC),
+	}
+	client := &mockClient{
+		iterator: &mockRowIterator{
+			rows: []map[string]bigquery.Value{
+				{"shard": int64(1), "key": `{"continent_code":"EU"}`},
+				{"shard": int64(1), "key": `{"continent_code":"NA"}`},
+				{"shard": int64(7), "key": `{"continent_code":"AF"}`},
+			},
+		},
+	}
+	exporter := &JSONExporter{
+		bqClient: client,
+		format:   formatter.NewStatsQueryFormatter(),
+	}
+	ctx, cancel := jobs.WithBudget(context.Background(), 100)
+	defer cancel()
+	partitions, keys, err := exporter.getIncrementalPartitions(ctx,
+		"project.dataset.table", "date", []string{"continent_code"}, period)
+	if err != nil {
+		t.Fatalf("getIncrementalPartitions() returned err: %v", err)
+	}
+	if got := jobs.BytesProcessed(ctx); got != 10 {
+		t.Errorf("getIncrementalPartitions() charged %d bytes, want 10", got)
+	}
+	if !reflect.DeepEqual(partitions, []string{"1", "7"}) {
+		t.Errorf("getIncrementalPartitions() partitions = %v", partitions)
+	}
+	wantKeys := map[string][]string{
+		"1": {`{"continent_code":"EU"}`, `{"continent_code":"NA"}`},
+		"7": {`{"continent_code":"AF"}`},
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("getIncrementalPartitions() keys = %v, want %v", keys, wantKeys)
+	}
+	if len(client.queries) != 1 ||
+		!strings.Contains(client.queries[0], "date BETWEEN @startdate AND @enddate") {
+		t.Errorf("getIncrementalPartitions() ran unexpected queries: %v",
+			client.queries)
+	}
+
+	// A missing date field must return an error.
+	_, _, err = exporter.getIncrementalPartitions(context.Background(),
+		"project.dataset.table", "", []string{"continent_code"}, period)
+	if err == nil {
+		t.Errorf("getIncrementalPartitions(): expected err, got nil")
+	}
+}
+
+func Test_restrictedSource(t *testing.T) {
+	want := "(SELECT * FROM `p.d.t` WHERE TO_JSON_STRING(STRUCT(a, b)) IN UNNEST(@keys))"
+	if got := restrictedSource("p.d.t", []string{"a", "b"}); got != want {
+		t.Errorf("restrictedSource() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,241 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+// pathFuncs are the functions available in output path templates. They only
+// transform values, so that output paths stay a function of the row's fields.
+// They fail on NULL values, like Execute does for values used directly.
+var pathFuncs = template.FuncMap{
+	// lower and upper change the case of a value, e.g. {{ .city | lower }}.
+	"lower": func(v interface{}) (string, error) {
+		s, err := pathValue(v)
+		return strings.ToLower(s), err
+	},
+	"upper": func(v interface{}) (string, error) {
+		s, err := pathValue(v)
+		return strings.ToUpper(s), err
+	},
+	// pad left-pads a value with zeros, e.g. {{ .asn | pad 6 }}.
+	"pad": func(width int, v interface{}) (string, error) {
+		s, err := pathValue(v)
+		if err != nil || len(s) >= width {
+			return s, err
+		}
+		return strings.Repeat("0", width-len(s)) + s, nil
+	},
+	// escape escapes a value so it can be used as a single path segment,
+	// e.g. spaces and slashes in city names.
+	"escape": func(v interface{}) (string, error) {
+		s, err := pathValue(v)
+		return url.PathEscape(s), err
+	},
+	// replace replaces all the occurrences of old with new in a value, e.g.
+	// {{ .city | replace " " "_" }}.
+	"replace": func(old, new string, v interface{}) (string, error) {
+		s, err := pathValue(v)
+		return strings.ReplaceAll(s, old, new), err
+	},
+}
+
+// pathValue formats a value passed to one of the pathFuncs. It fails if the
+// value is NULL or missing, instead of returning "<nil>".
+func pathValue(v interface{}) (string, error) {
+	if v == nil {
+		return "", errors.New("missing value")
+	}
+	return fmt.Sprint(v), nil
+}
+
+// periodParams returns the parameters describing the exported period, which
+// are available to both the export query and the output path templates:
+//   - period: the period's table suffix, e.g. "2020_01" for monthly tables
+//   - periodStart and periodEnd: the first and last exported dates
+//     (YYYY-MM-DD), which may only cover part of the period
+//
+// With periods shorter than a year, output paths must use {{ .period }} for
+// the files of different periods to have different names.
+func periodParams(period config.Period) map[string]string {
+	return map[string]string{
+		"period":      period.Suffix(),
+		"periodStart": period.Start.Format(dateFormat),
+		"periodEnd":   period.End.Format(dateFormat),
+	}
+}
+
+// isPeriodParam reports whether name is one of the periodParams.
+func isPeriodParam(name string) bool {
+	_, ok := periodParams(config.Period{})[name]
+	return ok
+}
+
+// outputPathTemplate is a parsed output path template.
+type outputPathTemplate struct {
+	tpl *template.Template
+
+	// params are the periodParams of the exported period. They take
+	// precedence over the row fields having the same name.
+	params map[string]string
+
+	// fields are the row fields used in the template, in order of appearance.
+	// The periodParams are not row fields.
+	fields []string
+
+	// separators is the number of "/" in the template's text, or -1 if the
+	// template has control structures.
+	separators int
+
+	// usesPeriod is true if the template uses any of the periodParams.
+	usesPeriod bool
+}
+
+// parseOutputPath parses an output path template and returns the row fields
+// it uses. It fails if the template uses no row fields.
+func parseOutputPath(path string) (*outputPathTemplate, error) {
+	tpl, err := template.New("outputPath").Funcs(pathFuncs).Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &outputPathTemplate{
+		tpl: tpl,
+	}
+	seen := map[string]bool{}
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.TextNode:
+			if p.separators >= 0 {
+				p.separators += strings.Count(string(n.Text), "/")
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			if isPeriodParam(n.Ident[0]) {
+				p.usesPeriod = true
+			} else if !seen[n.Ident[0]] {
+				seen[n.Ident[0]] = true
+				p.fields = append(p.fields, n.Ident[0])
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IfNode:
+			p.separators = -1
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			p.separators = -1
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			p.separators = -1
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			p.separators = -1
+			walk(n.Pipe)
+		}
+	}
+	walk(tpl.Tree.Root)
+	if len(p.fields) == 0 {
+		return nil, errors.New("no fields found in the path template")
+	}
+	return p, nil
+}
+
+// OutputPathFields returns the row fields used in an output path template, in
+// order of appearance, without the period parameters. It fails if the template
+// is invalid or uses no row fields.
+func OutputPathFields(path string) ([]string, error) {
+	p, err := parseOutputPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.fields, nil
+}
+
+// forPeriod returns a copy of the template rendering the given period's
+// periodParams. It fails if the period is shorter than a year and the
+// template doesn't use the periodParams, since the files of every period of
+// the same year would then have the same names.
+func (p *outputPathTemplate) forPeriod(period config.Period) (*outputPathTemplate, error) {
+	if !p.usesPeriod && period.Granularity != "" &&
+		period.Granularity != config.Yearly {
+		return nil, fmt.Errorf("the output path of %s periods must use "+
+			"{{ .period }}", period.Granularity)
+	}
+	c := *p
+	c.params = periodParams(period)
+	return &c, nil
+}
+
+// Execute renders the output path for the given row and checks that the
+// result is a safe object name: a relative path without empty, "." or ".."
+// segments, without missing values or control characters, and without
+// separators coming from the row's values.
+func (p *outputPathTemplate) Execute(row bqRow) (string, error) {
+	data := row
+	if p.params != nil {
+		data = make(bqRow, len(row)+len(p.params))
+		for k, v := range row {
+			data[k] = v
+		}
+		for k, v := range p.params {
+			data[k] = v
+		}
+	}
+	var buf strings.Builder
+	err := p.tpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	path := buf.String()
+	if p.separators >= 0 && strings.Count(path, "/") != p.separators {
+		return "", fmt.Errorf("invalid output path %q: a value contains \"/\"",
+			path)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		switch {
+		case segment == "" || segment == "." || segment == "..":
+			return "", fmt.Errorf("invalid output path %q: bad segment %q",
+				path, segment)
+		case strings.Contains(segment, "<no value>"):
+			return "", fmt.Errorf("invalid output path %q: missing value",
+				path)
+		case strings.IndexFunc(segment, unicode.IsControl) >= 0 ||
+			strings.Contains(segment, "\\"):
+			return "", fmt.Errorf("invalid output path %q: invalid character",
+				path)
+		}
+	}
+	return path, nil
+}
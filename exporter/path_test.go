@@ -0,0 +1,374 @@
+package exporter
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+func Test_parseOutputPath(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		wantFields     []string
+		wantSeparators int
+		wantErr        bool
+	}{
+		{
+			name:           "ok",
+			path:           "{{ .foo }}/{{.bar}}",
+			wantFields:     []string{"foo", "bar"},
+			wantSeparators: 1,
+		},
+		{
+			name:           "functions",
+			path:           "v0/{{ .city | lower | escape }}/{{ pad 6 .asn }}/{{ .city }}.json",
+			wantFields:     []string{"city", "asn"},
+			wantSeparators: 3,
+		},
+		{
+			name:           "urlquery",
+			path:           "{{ .city | urlquery }}/stats.json",
+			wantFields:     []string{"city"},
+			wantSeparators: 1,
+		},
+		{
+			name:           "control-structures",
+			path:           "{{ if .asn }}asn/{{ .asn }}/{{ end }}{{ .year }}/stats.json",
+			wantFields:     []string{"asn", "year"},
+			wantSeparators: -1,
+		},
+		{
+			name:           "period",
+			path:           "{{ .period }}/{{ .city }}/{{ .periodStart }}.json",
+			wantFields:     []string{"city"},
+			wantSeparators: 2,
+		},
+		{
+			name:    "no-fields",
+			path:    "output.json",
+			wantErr: true,
+		},
+		{
+			name:    "only-period",
+			path:    "{{ .period }}/output.json",
+			wantErr: true,
+		},
+		{
+			name:    "undefined-function",
+			path:    "{{foo}}/{{bar}}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOutputPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOutputPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.fields, tt.wantFields) {
+				t.Errorf("parseOutputPath() fields = %v, want %v", got.fields,
+					tt.wantFields)
+			}
+			if got.separators != tt.wantSeparators {
+				t.Errorf("parseOutputPath() separators = %d, want %d",
+					got.separators, tt.wantSeparators)
+			}
+		})
+	}
+}
+
+func TestOutputPathFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "functions",
+			path: "v0/{{ pad 6 .asn }}/{{ .city | lower }}/{{ .asn }}.json",
+			want: []string{"asn", "city"},
+		},
+		{
+			name:    "no-fields",
+			path:    "output.json",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OutputPathFields(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OutputPathFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("OutputPathFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_outputPathTemplate_Execute(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		row     bqRow
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			path: "{{ .year }}/{{ .city }}/stats.json",
+			row:  bqRow{"year": int64(2020), "city": "New York"},
+			want: "2020/New York/stats.json",
+		},
+		{
+			name: "functions",
+			path: "{{ .city | lower | replace \" \" \"_\" }}/{{ .asn | pad 6 }}/{{ .region | upper }}.json",
+			row:  bqRow{"city": "New York", "asn": int64(1234), "region": "us-ny"},
+			want: "new_york/001234/US-NY.json",
+		},
+		{
+			name: "escaped-slash",
+			path: "{{ .city | escape }}/stats.json",
+			row:  bqRow{"city": "A/B"},
+			want: "A%2FB/stats.json",
+		},
+		{
+			name:    "value-with-slash",
+			path:    "{{ .city }}/stats.json",
+			row:     bqRow{"city": "A/B"},
+			wantErr: true,
+		},
+		{
+			name:    "dot-dot",
+			path:    "{{ .city }}/stats.json",
+			row:     bqRow{"city": ".."},
+			wantErr: true,
+		},
+		{
+			name:    "empty-value",
+			path:    "{{ .country }}/{{ .city }}/stats.json",
+			row:     bqRow{"country": "US", "city": ""},
+			wantErr: true,
+		},
+		{
+			name:    "missing-value",
+			path:    "{{ .city }}/stats.json",
+			row:     bqRow{},
+			wantErr: true,
+		},
+		{
+			name:    "null-value",
+			path:    "{{ .city }}/stats.json",
+			row:     bqRow{"city": nil},
+			wantErr: true,
+		},
+		{
+			name:    "null-lower",
+			path:    "{{ .city | lower }}/stats.json",
+			row:     bqRow{"city": nil},
+			wantErr: true,
+		},
+		{
+			name:    "null-upper",
+			path:    "{{ .city | upper }}/stats.json",
+			row:     bqRow{"city": nil},
+			wantErr: true,
+		},
+		{
+			name:    "null-pad",
+			path:    "{{ .asn | pad 6 }}/stats.json",
+			row:     bqRow{"asn": nil},
+			wantErr: true,
+		},
+		{
+			name:    "null-escape",
+			path:    "{{ .city | escape }}/stats.json",
+			row:     bqRow{"city": nil},
+			wantErr: true,
+		},
+		{
+			name:    "null-replace",
+			path:    "{{ .city | replace \" \" \"_\" }}/stats.json",
+			row:     bqRow{"city": nil},
+			wantErr: true,
+		},
+		{
+			name:    "missing-lower",
+			path:    "{{ .city | lower }}/stats.json",
+			row:     bqRow{},
+			wantErr: true,
+		},
+		{
+			name:    "absolute",
+			path:    "/{{ .city }}/stats.json",
+			row:     bqRow{"city": "Rome"},
+			wantErr: true,
+		},
+		{
+			name:    "control-character",
+			path:    "{{ .city }}/stats.json",
+			row:     bqRow{"city": "Ro\nme"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseOutputPath(tt.path)
+			if err != nil {
+				t.Fatalf("parseOutputPath() error = %v", err)
+			}
+			got, err := p.Execute(tt.row)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_outputPathTemplate_forPeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		granularity string
+		row         bqRow
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "monthly",
+			path:        "{{ .city }}/{{ .period }}/{{ .periodStart }}_{{ .periodEnd }}.json",
+			granularity: config.Monthly,
+			row:         bqRow{"city": "Rome"},
+			want:        "Rome/2020_02/2020-02-01_2020-02-29.json",
+		},
+		{
+			name:        "quarterly",
+			path:        "{{ .city }}/{{ .period }}.json",
+			granularity: config.Quarterly,
+			row:         bqRow{"city": "Rome"},
+			want:        "Rome/2020_q1.json",
+		},
+		{
+			name:        "period-overrides-row",
+			path:        "{{ .city }}/{{ .period }}.json",
+			granularity: config.Yearly,
+			row:         bqRow{"city": "Rome", "period": "other"},
+			want:        "Rome/2020.json",
+		},
+		{
+			name:        "yearly-without-period",
+			path:        "{{ .city }}/{{ .year }}.json",
+			granularity: config.Yearly,
+			row:         bqRow{"city": "Rome", "year": int64(2020)},
+			want:        "Rome/2020.json",
+		},
+		{
+			name:        "monthly-without-period",
+			path:        "{{ .city }}/{{ .year }}.json",
+			granularity: config.Monthly,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseOutputPath(tt.path)
+			if err != nil {
+				t.Fatalf("parseOutputPath() error = %v", err)
+			}
+			period, err := config.PeriodOf(time.Date(2020, time.February, 10,
+				0, 0, 0, 0, time.UTC), tt.granularity)
+			if err != nil {
+				t.Fatalf("PeriodOf() error = %v", err)
+			}
+			p, err = p.forPeriod(period)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("forPeriod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := p.Execute(tt.row)
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Execute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_outputPathTemplate_Execute_configs(t *testing.T) {
+	// sample has a value for every output path field of the configs, of
+	// the type returned by the export queries.
+	sample := bqRow{
+		"year":              int64(2020),
+		"continent_code":    "NA",
+		"country_code":      "US",
+		"ISO3166_2region1":  "US-NY",
+		"city":              "New York",
+		"asn":               "AS15169",
+		"GEOID":             "36061",
+		"month":             "03",
+		"day":               "10",
+		"UUID":              "ndt-abc",
+		"Year":              "2021",
+		"Month":             "09",
+		"Day":               "08",
+		"FilenameTimestamp": "20210908T000000Z",
+		"Hostname":          "mlab1-lga03",
+		"IP":                "192.0.2.1",
+	}
+	want := map[string]string{
+		"tcpinfo":    "annotation/2020/03/10/ndt-abc.json",
+		"traceroute": "hopannotation1/2021/09/08/20210908T000000Z_mlab1-lga03_192.0.2.1.json",
+		"global":     "v0/2020/histogram_daily_stats.json",
+	}
+	files := []string{
+		"../config.json",
+		"../k8s/data-pipeline/config/config.json",
+		"../k8s/data-pipeline/config/config-annotation-export.json",
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("cannot read %s: %v", file, err)
+		}
+		var configs map[string]config.Config
+		if err := json.Unmarshal(content, &configs); err != nil {
+			t.Fatalf("cannot parse %s: %v", file, err)
+		}
+		for name, c := range configs {
+			if c.ExportQueryFile == "" {
+				// Histogram-only config, e.g. the canary.
+				continue
+			}
+			t.Run(file+":"+name, func(t *testing.T) {
+				p, err := parseOutputPath(c.OutputPath)
+				if err != nil {
+					t.Fatalf("parseOutputPath() error = %v", err)
+				}
+				got, err := p.Execute(sample)
+				if err != nil {
+					t.Fatalf("Execute() error = %v", err)
+				}
+				if w, ok := want[name]; ok && got != w {
+					t.Errorf("Execute() = %q, want %q", got, w)
+				}
+			})
+		}
+	}
+}
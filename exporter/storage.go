@@ -0,0 +1,30 @@
+package exporter
+
+import (
+	"context"
+	"flag"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+var storageRead = flag.Bool("exporter.storage-read", false,
+	"Read export query results through the BigQuery Storage Read API "+
+		"instead of paging through them with the BigQuery API")
+
+// EnableStorageRead makes client read the results of query jobs through the
+// BigQuery Storage Read API if the -exporter.storage-read flag is set.
+//
+// Each export query reads a single partition, and the output path's fields
+// determine the partition, so every file is read by a single query. The
+// partitions are read in parallel by the query workers, each with its own
+// read session. Within a session, the client uses a single stream for
+// queries with ORDER BY, so rows reach processQueryResults in the same order
+// as with the BigQuery API.
+func EnableStorageRead(ctx context.Context, client *bigquery.Client,
+	opts ...option.ClientOption) error {
+	if !*storageRead {
+		return nil
+	}
+	return client.EnableStorageReadClient(ctx, opts...)
+}
@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+func TestEnableStorageRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		storageRead bool
+		wantEnabled bool
+	}{
+		{
+			name:        "disabled",
+			storageRead: false,
+		},
+		{
+			name:        "enabled",
+			storageRead: true,
+			wantEnabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			opts := []option.ClientOption{
+				option.WithoutAuthentication(),
+				option.WithEndpoint("localhost:0"),
+			}
+			client, err := bigquery.NewClient(ctx, "test-project", opts...)
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			defer client.Close()
+			defer func(v bool) { *storageRead = v }(*storageRead)
+			*storageRead = tt.storageRead
+
+			if err := EnableStorageRead(ctx, client, opts...); err != nil {
+				t.Fatalf("EnableStorageRead() error = %v", err)
+			}
+			// The client refuses to set up a second Storage Read API client.
+			err = client.EnableStorageReadClient(ctx, opts...)
+			if enabled := err != nil; enabled != tt.wantEnabled {
+				t.Errorf("EnableStorageRead() enabled = %v, want %v", enabled,
+					tt.wantEnabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/stats-pipeline/formatter"
+	"github.com/m-lab/stats-pipeline/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+var streamUploads = flag.Bool("exporter.stream-uploads", false,
+	"Stream files to the output while reading rows, if the output and the "+
+		"formatter support it, instead of building them in memory. Streamed "+
+		"files are written by the query workers, so -exporter.max-bytes-in-flight "+
+		"does not apply to them")
+
+// StreamWriter is a Writer that can also stream content to a path, so that
+// files of any size can be written with bounded memory. The returned
+// io.WriteCloser must only create the file when closed, and must not create it
+// if ctx has been canceled.
+type StreamWriter interface {
+	Writer
+	NewWriter(ctx context.Context, path string) (io.WriteCloser, error)
+}
+
+// StreamFormatter is a Formatter that can also encode rows one at a time.
+type StreamFormatter interface {
+	Formatter
+	NewEncoder(w io.Writer) formatter.RowEncoder
+}
+
+// streamFile is a file being streamed to the output.
+type streamFile struct {
+	objName string
+	w       io.WriteCloser
+	counter *countingWriter
+	enc     formatter.RowEncoder
+	cancel  context.CancelFunc
+	span    trace.Span
+	err     error
+}
+
+// countingWriter counts the bytes written to the underlying io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// canStream returns the output and formatter to use for streaming files, if
+// streaming is enabled and possible for the current export.
+func (exporter *JSONExporter) canStream() (StreamWriter, StreamFormatter, bool) {
+	if !*streamUploads || exporter.collisionMode == mergeCollisions {
+		return nil, nil, false
+	}
+	sw, ok := exporter.output.(StreamWriter)
+	if !ok {
+		return nil, nil, false
+	}
+	sf, ok := exporter.format.(StreamFormatter)
+	if !ok {
+		return nil, nil, false
+	}
+	return sw, sf, true
+}
+
+// streamQueryResults loops over a RowIterator like processQueryResults, but
+// each row is encoded and written to its file's output stream as soon as it
+// is read. When the row key changes, the current file is closed, which
+// completes its upload, and a new one is opened.
+func (exporter *JSONExporter) streamQueryResults(ctx context.Context,
+	it bqiface.RowIterator, j *QueryJob, sw StreamWriter,
+	sf StreamFormatter) error {
+	var file *streamFile
+	var lastRow bqRow
+	var currentRow bqRow
+	var err error
+	// Setting MaxSize here allows to fetch more rows with a single fetch.
+	it.PageInfo().MaxSize = 100000
+
+	for err = it.Next(&currentRow); err == nil; err = it.Next(&currentRow) {
+		// A new file starts with the first row and whenever any of j.fields
+		// changes between this row and the previous one.
+		newFile := lastRow == nil
+		for _, f := range j.fields {
+			if lastRow != nil && currentRow[f] != lastRow[f] {
+				newFile = true
+				break
+			}
+		}
+		if newFile {
+			if file != nil {
+				exporter.closeStream(ctx, j, file)
+			}
+			file = exporter.openStream(ctx, j, sw, sf, currentRow)
+		}
+		// Rows of files that could not be opened, or of files that have
+		// failed, are skipped. The partitionField is removed from the output.
+		if file != nil && file.err == nil {
+			file.err = file.enc.Encode(removeFieldsFromRow(currentRow,
+				[]string{partitionField}))
+		}
+		// Save relevant fields for comparison in the next iteration.
+		if lastRow == nil {
+			lastRow = make(bqRow)
+		}
+		for _, f := range j.fields {
+			lastRow[f] = currentRow[f]
+		}
+	}
+
+	if file != nil {
+		if err != iterator.Done && file.err == nil {
+			// Do not create a truncated file.
+			file.err = err
+		}
+		exporter.closeStream(ctx, j, file)
+	}
+	if err == iterator.Done {
+		// This is the expected behavior, so we don't consider this an error.
+		return nil
+	}
+	return err
+}
+
+// openStream starts streaming a new file whose output path is given by row.
+// It returns nil if the file must not be written.
+func (exporter *JSONExporter) openStream(ctx context.Context, j *QueryJob,
+	sw StreamWriter, sf StreamFormatter, row bqRow) *streamFile {
+	objName, err := j.outputPath.Execute(row)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot render output path", "error", err)
+		writtenFiles.WithLabelValues(j.name, exporter.year, "false").Inc()
+		return nil
+	}
+	if !exporter.trackPath(ctx, j.name, objName, nil) {
+		return nil
+	}
+	fileCtx, span := startUploadSpan(ctx, objName)
+	fileCtx, cancel := context.WithCancel(fileCtx)
+	w, err := sw.NewWriter(fileCtx, objName)
+	if err != nil {
+		cancel()
+		tracing.SetError(span, err)
+		span.End()
+		slog.ErrorContext(ctx, "cannot create file", "path", objName,
+			"error", err)
+		exporter.sendResult(j.name, objName, 0, err)
+		return nil
+	}
+	counter := &countingWriter{w: w}
+	return &streamFile{
+		objName: objName,
+		w:       w,
+		counter: counter,
+		enc:     sf.NewEncoder(counter),
+		cancel:  cancel,
+		span:    span,
+	}
+}
+
+// closeStream completes a file, or aborts it if any of its rows failed.
+func (exporter *JSONExporter) closeStream(ctx context.Context, j *QueryJob,
+	file *streamFile) {
+	err := file.err
+	if err == nil {
+		err = file.enc.Close()
+	}
+	if err != nil {
+		// Canceling the context makes sure the file is not created.
+		file.cancel()
+		file.w.Close()
+		err = fmt.Errorf("cannot write %s: %v", file.objName, err)
+		slog.ErrorContext(ctx, "cannot write file", "path", file.objName,
+			"error", err)
+	} else {
+		err = file.w.Close()
+		file.cancel()
+	}
+	file.span.SetAttributes(attribute.Int64("bytes", file.counter.n))
+	tracing.SetError(file.span, err)
+	file.span.End()
+	exporter.sendResult(j.name, file.objName, file.counter.n, err)
+}
+
+// sendResult updates the metrics for a written file and sends its result to
+// the results channel.
+func (exporter *JSONExporter) sendResult(table, objName string, size int64,
+	err error) {
+	writtenFiles.WithLabelValues(table, exporter.year, fmt.Sprintf("%t", err == nil)).Inc()
+	if err == nil {
+		uploadedBytesMetric.WithLabelValues(table, exporter.year).Add(float64(size))
+	}
+	exporter.results <- UploadResult{
+		objName: objName,
+		err:     err,
+	}
+}
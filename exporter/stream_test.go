@@ -0,0 +1,246 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/stats-pipeline/formatter"
+)
+
+// mockStreamWriter is a StreamWriter keeping the files in memory.
+type mockStreamWriter struct {
+	mockWriter
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (w *mockStreamWriter) NewWriter(ctx context.Context, path string) (io.WriteCloser, error) {
+	return &mockStream{ctx: ctx, w: w, path: path}, nil
+}
+
+type mockStream struct {
+	bytes.Buffer
+	ctx  context.Context
+	w    *mockStreamWriter
+	path string
+}
+
+func (s *mockStream) Close() error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	s.w.files[s.path] = s.String()
+	return nil
+}
+
+// enableStreaming sets -exporter.stream-uploads for the duration of a test.
+func enableStreaming(t *testing.T, enabled bool) {
+	old := *streamUploads
+	*streamUploads = enabled
+	t.Cleanup(func() { *streamUploads = old })
+}
+
+func TestJSONExporter_streamQueryResults(t *testing.T) {
+	enableStreaming(t, true)
+	tests := []struct {
+		name        string
+		rows        []map[string]bigquery.Value
+		iterErr     error
+		want        map[string]string
+		wantErr     bool
+		wantResults int
+		wantFailed  int
+	}{
+		{
+			name: "success",
+			rows: []map[string]bigquery.Value{
+				{"year": int64(2020), "value": 1, "shard": int64(1)},
+				{"year": int64(2020), "value": 2, "shard": int64(1)},
+				{"year": int64(2021), "value": 3, "shard": int64(1)},
+			},
+			want: map[string]string{
+				"2020/output.json": `[{"value":1,"year":2020},{"value":2,"year":2020}]`,
+				"2021/output.json": `[{"value":3,"year":2021}]`,
+			},
+			wantResults: 2,
+		},
+		{
+			name: "encoding-error",
+			rows: []map[string]bigquery.Value{
+				{"year": int64(2020), "value": 1},
+				{"year": int64(2021), "value": make(chan int)},
+				{"year": int64(2021), "value": 2},
+				{"year": int64(2022), "value": 3},
+			},
+			want: map[string]string{
+				"2020/output.json": `[{"value":1,"year":2020}]`,
+				"2022/output.json": `[{"value":3,"year":2022}]`,
+			},
+			wantResults: 3,
+			wantFailed:  1,
+		},
+		{
+			name: "invalid-path",
+			rows: []map[string]bigquery.Value{
+				{"year": "..", "value": 1},
+				{"year": int64(2020), "value": 2},
+			},
+			want: map[string]string{
+				"2020/output.json": `[{"value":2,"year":2020}]`,
+			},
+			wantResults: 1,
+		},
+		{
+			name:    "iterator-error",
+			iterErr: errors.New("iterator failed"),
+			want:    map[string]string{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw := &mockStreamWriter{files: map[string]string{}}
+			exporter := &JSONExporter{
+				output:  sw,
+				format:  formatter.NewStatsQueryFormatter(),
+				results: make(chan UploadResult),
+			}
+			outputPath, err := parseOutputPath("{{ .year }}/output.json")
+			if err != nil {
+				t.Fatalf("parseOutputPath() returned err: %v", err)
+			}
+			j := &QueryJob{
+				name:       "test",
+				fields:     outputPath.fields,
+				outputPath: outputPath,
+			}
+			it := &mockRowIterator{
+				rows:    tt.rows,
+				iterErr: tt.iterErr,
+			}
+			var results []UploadResult
+			done := make(chan bool)
+			go func() {
+				for res := range exporter.results {
+					results = append(results, res)
+				}
+				done <- true
+			}()
+			sw2, sf, ok := exporter.canStream()
+			if !ok {
+				t.Fatalf("canStream() returned false")
+			}
+			err = exporter.streamQueryResults(context.Background(), it, j,
+				sw2, sf)
+			close(exporter.results)
+			<-done
+			if (err != nil) != tt.wantErr {
+				t.Errorf("streamQueryResults() error = %v, wantErr %v", err,
+					tt.wantErr)
+			}
+			if !reflect.DeepEqual(sw.files, tt.want) {
+				t.Errorf("streamQueryResults() wrote %v, want %v", sw.files,
+					tt.want)
+			}
+			failed := 0
+			for _, res := range results {
+				if res.err != nil {
+					failed++
+				}
+			}
+			if len(results) != tt.wantResults || failed != tt.wantFailed {
+				t.Errorf("streamQueryResults() sent %d results (%d failed), want %d (%d failed)",
+					len(results), failed, tt.wantResults, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestJSONExporter_streamMatchesMarshal(t *testing.T) {
+	f := formatter.NewStatsQueryFormatter()
+	rows := []bqRow{
+		{"a": "<b>", "n": 1.5},
+		{"a": "c", "n": nil},
+	}
+	want, err := f.Marshal(rows)
+	if err != nil {
+		t.Fatalf("Marshal() returned err: %v", err)
+	}
+	var buf bytes.Buffer
+	enc := f.NewEncoder(&buf)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			t.Fatalf("Encode() returned err: %v", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close() returned err: %v", err)
+	}
+	if buf.String() != string(want) {
+		t.Errorf("streamed %s, want %s", buf.String(), want)
+	}
+}
+
+func TestJSONExporter_canStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter *JSONExporter
+		disabled bool
+		want     bool
+	}{
+		{
+			name: "ok",
+			exporter: &JSONExporter{
+				output: &mockStreamWriter{},
+				format: formatter.NewStatsQueryFormatter(),
+			},
+			want: true,
+		},
+		{
+			name: "disabled",
+			exporter: &JSONExporter{
+				output: &mockStreamWriter{},
+				format: formatter.NewStatsQueryFormatter(),
+			},
+			disabled: true,
+		},
+		{
+			name: "writer-without-streams",
+			exporter: &JSONExporter{
+				output: &mockWriter{},
+				format: formatter.NewStatsQueryFormatter(),
+			},
+		},
+		{
+			name: "formatter-without-streams",
+			exporter: &JSONExporter{
+				output: &mockStreamWriter{},
+				format: formatter.NewTCPINFOAnnotationQueryFormatter(),
+			},
+		},
+		{
+			name: "merge-collisions",
+			exporter: &JSONExporter{
+				output:        &mockStreamWriter{},
+				format:        formatter.NewStatsQueryFormatter(),
+				collisionMode: mergeCollisions,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enableStreaming(t, !tt.disabled)
+			if _, _, got := tt.exporter.canStream(); got != tt.want {
+				t.Errorf("canStream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/m-lab/stats-pipeline/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/m-lab/stats-pipeline/exporter")
+
+// startExportSpan starts the span of an export of the given config and period.
+func startExportSpan(ctx context.Context, c config.Config, period config.Period,
+	incremental bool) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "exporter.Export", trace.WithAttributes(
+		attribute.String("table", c.Table),
+		attribute.String("period", period.Suffix()),
+		attribute.Bool("incremental", incremental),
+	))
+}
+
+// startQueryJobSpan starts the span of a QueryJob. The BigQuery job's ID and
+// statistics are added once it has completed.
+func startQueryJobSpan(ctx context.Context, j *QueryJob) (context.Context,
+	trace.Span) {
+	attrs := append([]attribute.KeyValue{attribute.String("table", j.name)},
+		tracing.QueryAttributes(jobs.Labels(ctx)["config"], j.query)...)
+	return tracer.Start(ctx, "exporter.QueryJob", trace.WithAttributes(attrs...))
+}
+
+// startUploadSpan starts the span of a file upload, i.e. of an UploadJob or of
+// a streamed file.
+func startUploadSpan(ctx context.Context, objName string) (context.Context,
+	trace.Span) {
+	return tracer.Start(ctx, "exporter.UploadJob", trace.WithAttributes(
+		attribute.String("object", objName),
+	))
+}
@@ -0,0 +1,55 @@
+package formatter
+
+import (
+	"encoding/json"
+	"io"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// RowEncoder encodes export query rows one at a time to an io.Writer, so that
+// files can be written without holding all their rows in memory.
+type RowEncoder interface {
+	// Encode writes a single row.
+	Encode(row map[string]bigquery.Value) error
+	// Close writes anything needed to terminate the encoded rows. It does
+	// not close the underlying io.Writer.
+	Close() error
+}
+
+// jsonArrayEncoder encodes rows as a JSON array. The output is the same as
+// json.Marshal on the slice of rows.
+type jsonArrayEncoder struct {
+	w     io.Writer
+	count int
+}
+
+// Encode writes a row as the next element of the JSON array.
+func (e *jsonArrayEncoder) Encode(row map[string]bigquery.Value) error {
+	j, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sep := []byte{','}
+	if e.count == 0 {
+		sep = []byte{'['}
+	}
+	if _, err = e.w.Write(sep); err != nil {
+		return err
+	}
+	if _, err = e.w.Write(j); err != nil {
+		return err
+	}
+	e.count++
+	return nil
+}
+
+// Close terminates the JSON array.
+func (e *jsonArrayEncoder) Close() error {
+	end := []byte{']'}
+	if e.count == 0 {
+		end = []byte("[]")
+	}
+	_, err := e.w.Write(end)
+	return err
+}
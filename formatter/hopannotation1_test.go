@@ -17,7 +17,7 @@ func TestHopAnnotation1QueryFormatter_Source(t *testing.T) {
 		name    string
 		project string
 		config  config.Config
-		year    int
+		period  config.Period
 		want    string
 	}{
 		{
@@ -27,14 +27,16 @@ func TestHopAnnotation1QueryFormatter_Source(t *testing.T) {
 				Dataset: "base_tables",
 				Table:   "traceroute",
 			},
-			year: 2019,
+			period: config.Period{
+				Start: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+			},
 			want: "mlab-testing.base_tables.traceroute",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewTracerouteHopAnnotation1QueryFormatter()
-			if got := f.Source(tt.project, tt.config, tt.year); got != tt.want {
+			if got := f.Source(tt.project, tt.config, tt.period); got != tt.want {
 				t.Errorf("HopAnnotation1QueryFormatter.Source() = %#v, want %#v", got, tt.want)
 			}
 		})
@@ -45,14 +47,20 @@ func TestHopAnnotation1QueryFormatter_Partitions(t *testing.T) {
 	tests := []struct {
 		name   string
 		source string
+		period config.Period
 		want   string
 	}{
 		{
 			name:   "success",
 			source: "a.b.c",
+			period: config.Period{
+				Granularity: config.Yearly,
+				Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+				End:         time.Date(2021, time.September, 8, 0, 0, 0, 0, time.UTC),
+			},
 			want: `SELECT DATE(TestTime) as date
          FROM a.b.c
-         WHERE DATE(TestTime) BETWEEN DATE('2019-03-29') AND DATE('2021-09-08')
+         WHERE DATE(TestTime) BETWEEN DATE('2021-01-01') AND DATE('2021-09-08')
          GROUP BY date
          ORDER BY date`,
 		},
@@ -60,7 +68,7 @@ func TestHopAnnotation1QueryFormatter_Partitions(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewTracerouteHopAnnotation1QueryFormatter()
-			if got := f.Partitions(tt.source); got != tt.want {
+			if got := f.Partitions(tt.source, tt.period); got != tt.want {
 				t.Errorf("HopAnnotation1QueryFormatter.Partitions() = %v, want %v", got, tt.want)
 			}
 		})
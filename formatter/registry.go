@@ -0,0 +1,77 @@
+package formatter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+// Default is the name of the formatter used by configs that do not set one.
+const Default = "stats"
+
+// Formatter is the interface for all types that format table sources and
+// queries used during the export process, and marshal their results.
+type Formatter interface {
+	Source(project string, config config.Config, period config.Period) string
+	Partitions(source string, period config.Period) string
+	Partition(row map[string]bigquery.Value) string
+	Marshal(rows []map[string]bigquery.Value) ([]byte, error)
+}
+
+// Factory creates a new Formatter for the given config.
+type Factory func(c config.Config) Formatter
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func init() {
+	Register("stats", func(config.Config) Formatter {
+		return NewStatsQueryFormatter()
+	})
+}
+
+// Register makes a formatter available by the provided name. It panics if
+// the name is empty or already registered.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("formatter: invalid registration")
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("formatter: %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New returns a new Formatter of the named type for the given config. An empty
+// name is the same as Default.
+func New(name string, c config.Config) (Formatter, error) {
+	if name == "" {
+		name = Default
+	}
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown formatter: %q", name)
+	}
+	return factory(c), nil
+}
+
+// Names returns the sorted names of the registered formatters.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,87 @@
+package formatter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  config.Config
+		want    Formatter
+		wantErr bool
+	}{
+		{
+			name: "",
+			want: &StatsQueryFormatter{},
+		},
+		{
+			name: "stats",
+			want: &StatsQueryFormatter{},
+		},
+		{
+			name: "annotation",
+			want: &AnnotationQueryFormatter{DateExpr: "DATE(TestTime)"},
+		},
+		{
+			name: "hopannotation1",
+			want: &HopAnnotation1QueryFormatter{DateExpr: "DATE(TestTime)"},
+		},
+		{
+			name: "hopannotation1",
+			config: config.Config{
+				PartitionDateExpr: "date",
+			},
+			want: &HopAnnotation1QueryFormatter{DateExpr: "date"},
+		},
+		{
+			name: "scamper1",
+			want: &Scamper1QueryFormatter{DateExpr: "date"},
+		},
+		{
+			name: "tcpinfo",
+			want: &TCPINFOQueryFormatter{DateExpr: "date"},
+		},
+		{
+			name:    "unknown",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.name, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("New() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-register", func(config.Config) Formatter {
+		return &StatsQueryFormatter{}
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test-register")
+		registryMu.Unlock()
+	}()
+	want := []string{"annotation", "hopannotation1", "scamper1", "stats", "tcpinfo", "test-register"}
+	if got := Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register() did not panic on a duplicate name")
+		}
+	}()
+	Register("stats", func(config.Config) Formatter {
+		return &StatsQueryFormatter{}
+	})
+}
@@ -0,0 +1,95 @@
+package formatter
+
+import (
+	"time"
+
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/traceroute-caller/hopannotation"
+	"github.com/m-lab/traceroute-caller/parser"
+	"github.com/m-lab/uuid-annotator/annotator"
+)
+
+// AnnotationQueryFormatter prepares export queries for annotation data exported
+// by the stats pipeline.
+type AnnotationQueryFormatter = TypedQueryFormatter[annotator.Annotations]
+
+// HopAnnotation1QueryFormatter prepares export queries for hopannotation1 data
+// exported by the stats pipeline.
+type HopAnnotation1QueryFormatter = TypedQueryFormatter[hopannotation.HopAnnotation1]
+
+// Scamper1QueryFormatter prepares export queries for the raw column of scamper1
+// tables.
+type Scamper1QueryFormatter = TypedQueryFormatter[parser.ScamperOutput]
+
+// TCPINFOQueryFormatter prepares export queries for the raw column of tcpinfo
+// tables.
+type TCPINFOQueryFormatter = TypedQueryFormatter[ConnectionLog]
+
+// ConnectionLog has the same fields as tcp-info's snapshot.ConnectionLog. The
+// snapshot package isn't used since it registers the tcp-info collector's
+// metrics.
+type ConnectionLog struct {
+	Metadata struct {
+		UUID      string
+		Sequence  int
+		StartTime time.Time
+	}
+	Snapshots []Snapshot
+}
+
+// Snapshot has the same fields as tcp-info's snapshot.Snapshot.
+type Snapshot struct {
+	Timestamp           time.Time
+	Observed            uint32
+	NotFullyParsed      uint32
+	InetDiagMsg         *inetdiag.InetDiagMsg
+	CongestionAlgorithm string
+	TOS                 uint8
+	TClass              uint8
+	ClassID             uint8
+	Shutdown            uint8
+	Protocol            inetdiag.Protocol
+	Mark                uint32
+	TCPInfo             *tcp.LinuxTCPInfo
+	MemInfo             *inetdiag.MemInfo
+	SocketMem           *inetdiag.SocketMemInfo
+	VegasInfo           *inetdiag.VegasInfo
+	DCTCPInfo           *inetdiag.DCTCPInfo
+	BBRInfo             *inetdiag.BBRInfo
+}
+
+// NewTCPINFOAnnotationQueryFormatter creates a new AnnotationQueryFormatter.
+func NewTCPINFOAnnotationQueryFormatter() *AnnotationQueryFormatter {
+	return NewTypedQueryFormatter[annotator.Annotations]("DATE(TestTime)")
+}
+
+// NewTracerouteHopAnnotation1QueryFormatter creates a new HopAnnotation1QueryFormatter.
+func NewTracerouteHopAnnotation1QueryFormatter() *HopAnnotation1QueryFormatter {
+	return NewTypedQueryFormatter[hopannotation.HopAnnotation1]("DATE(TestTime)")
+}
+
+// Known M-Lab schemas, exported as one JSON object per file. Exporting a new
+// datatype with one of these schemas only requires a config using the schema's
+// name as formatter, and optionally setting PartitionDateExpr. The export query
+// must select the schema's fields as top-level columns, e.g. "raw.*" for
+// scamper1 and tcpinfo. Note that these files are single JSON objects, not the
+// JSONL files written by traceroute-caller and tcp-info.
+func init() {
+	RegisterSchema[annotator.Annotations]("annotation", "DATE(TestTime)")
+	RegisterSchema[hopannotation.HopAnnotation1]("hopannotation1", "DATE(TestTime)")
+	RegisterSchema[parser.ScamperOutput]("scamper1", "date")
+	RegisterSchema[ConnectionLog]("tcpinfo", "date")
+}
+
+// RegisterSchema registers a TypedQueryFormatter for T as the named formatter.
+// Rows are partitioned on dateExpr, unless the config sets PartitionDateExpr.
+func RegisterSchema[T any](name string, dateExpr string) {
+	Register(name, func(c config.Config) Formatter {
+		if c.PartitionDateExpr != "" {
+			return NewTypedQueryFormatter[T](c.PartitionDateExpr)
+		}
+		return NewTypedQueryFormatter[T](dateExpr)
+	})
+}
@@ -0,0 +1,53 @@
+package formatter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func TestConnectionLog(t *testing.T) {
+	tests := []struct {
+		name string
+		got  reflect.Type
+		want reflect.Type
+	}{
+		{
+			name: "ConnectionLog",
+			got:  reflect.TypeOf(ConnectionLog{}),
+			want: reflect.TypeOf(snapshot.ConnectionLog{}),
+		},
+		{
+			name: "Metadata",
+			got:  reflect.TypeOf(ConnectionLog{}.Metadata),
+			want: reflect.TypeOf(snapshot.ConnectionLog{}.Metadata),
+		},
+		{
+			name: "Snapshot",
+			got:  reflect.TypeOf(Snapshot{}),
+			want: reflect.TypeOf(snapshot.Snapshot{}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got.NumField() != tt.want.NumField() {
+				t.Fatalf("%s has %d fields, want %d", tt.name,
+					tt.got.NumField(), tt.want.NumField())
+			}
+			for i := 0; i < tt.want.NumField(); i++ {
+				got, want := tt.got.Field(i), tt.want.Field(i)
+				if got.Name != want.Name {
+					t.Errorf("%s field %d = %s, want %s", tt.name, i,
+						got.Name, want.Name)
+				}
+				// Nested M-Lab types are mirrored, so only their kind
+				// is compared.
+				if got.Type != want.Type && got.Type.Kind() != want.Type.Kind() {
+					t.Errorf("%s.%s type = %v, want %v", tt.name, want.Name,
+						got.Type, want.Type)
+				}
+			}
+		})
+	}
+}
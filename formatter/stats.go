@@ -4,11 +4,15 @@ package formatter
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/stats-pipeline/config"
 )
 
+// Format of the dates used in partition queries.
+const dateFormat = "2006-01-02"
+
 // StatsQueryFormatter prepares export queries for statstics in the stats pipeline.
 type StatsQueryFormatter struct{}
 
@@ -17,15 +21,16 @@ func NewStatsQueryFormatter() *StatsQueryFormatter {
 	return &StatsQueryFormatter{}
 }
 
-// Source returns a fully qualified bigquery table name including a year suffix
-// used by the stats pipeline.
-func (f *StatsQueryFormatter) Source(project string, config config.Config, year int) string {
-	return fmt.Sprintf("%s.%s.%s_%d", project, config.Dataset, config.Table, year)
+// Source returns a fully qualified bigquery table name including a period
+// suffix (e.g. the year) used by the stats pipeline.
+func (f *StatsQueryFormatter) Source(project string, config config.Config, period config.Period) string {
+	return fmt.Sprintf("%s.%s.%s_%s", project, config.Dataset, config.Table, period.Suffix())
 }
 
 // Partitions returns a bigquery query for listing all partitions for a given
-// source table.
-func (f *StatsQueryFormatter) Partitions(source string) string {
+// source table. The period is ignored, since the source table only contains
+// the period's rows.
+func (f *StatsQueryFormatter) Partitions(source string, period config.Period) string {
 	return fmt.Sprintf(
 		`SELECT shard
 	    FROM %s
@@ -56,3 +61,9 @@ func (f *StatsQueryFormatter) Marshal(rows []map[string]bigquery.Value) ([]byte,
 	}
 	return j, nil
 }
+
+// NewEncoder returns a RowEncoder writing rows to w in the same format as
+// Marshal.
+func (f *StatsQueryFormatter) NewEncoder(w io.Writer) RowEncoder {
+	return &jsonArrayEncoder{w: w}
+}
@@ -4,6 +4,7 @@ package formatter
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/stats-pipeline/config"
@@ -14,7 +15,7 @@ func TestStatsQueryFormatter_Source(t *testing.T) {
 		name    string
 		project string
 		config  config.Config
-		year    int
+		period  config.Period
 		want    string
 	}{
 		{
@@ -24,14 +25,43 @@ func TestStatsQueryFormatter_Source(t *testing.T) {
 				Dataset: "statistics",
 				Table:   "bananas",
 			},
-			year: 2019,
+			period: config.Period{
+				Granularity: config.Yearly,
+				Start:       time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+			},
 			want: "mlab-testing.statistics.bananas_2019",
 		},
+		{
+			name:    "success-quarterly",
+			project: "mlab-testing",
+			config: config.Config{
+				Dataset: "statistics",
+				Table:   "bananas",
+			},
+			period: config.Period{
+				Granularity: config.Quarterly,
+				Start:       time.Date(2019, time.August, 1, 0, 0, 0, 0, time.UTC),
+			},
+			want: "mlab-testing.statistics.bananas_2019_q3",
+		},
+		{
+			name:    "success-monthly",
+			project: "mlab-testing",
+			config: config.Config{
+				Dataset: "statistics",
+				Table:   "bananas",
+			},
+			period: config.Period{
+				Granularity: config.Monthly,
+				Start:       time.Date(2019, time.August, 1, 0, 0, 0, 0, time.UTC),
+			},
+			want: "mlab-testing.statistics.bananas_2019_08",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewStatsQueryFormatter()
-			if got := f.Source(tt.project, tt.config, tt.year); got != tt.want {
+			if got := f.Source(tt.project, tt.config, tt.period); got != tt.want {
 				t.Errorf("StatsQueryFormatter.Source() = %#v, want %#v", got, tt.want)
 			}
 		})
@@ -42,11 +72,17 @@ func TestStatsQueryFormatter_Partitions(t *testing.T) {
 	tests := []struct {
 		name   string
 		source string
+		period config.Period
 		want   string
 	}{
 		{
 			name:   "success",
 			source: "a.b.c",
+			period: config.Period{
+				Granularity: config.Yearly,
+				Start:       time.Date(2019, time.March, 29, 0, 0, 0, 0, time.UTC),
+				End:         time.Date(2019, time.December, 31, 0, 0, 0, 0, time.UTC),
+			},
 			want: `SELECT shard
 	    FROM a.b.c
 		GROUP BY shard
@@ -56,7 +92,7 @@ func TestStatsQueryFormatter_Partitions(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			f := NewStatsQueryFormatter()
-			if got := f.Partitions(tt.source); got != tt.want {
+			if got := f.Partitions(tt.source, tt.period); got != tt.want {
 				t.Errorf("StatsQueryFormatter.Partitions() = %v, want %v", got, tt.want)
 			}
 		})
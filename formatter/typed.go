@@ -0,0 +1,80 @@
+package formatter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+// TypedQueryFormatter prepares export queries for data exported as one JSON
+// object of type T per file, e.g. annotations. T must be a Go type that can be
+// unmarshalled from the JSON representation of a BigQuery row.
+type TypedQueryFormatter[T any] struct {
+	DateExpr string // BigQuery expression used to extract a row's date.
+}
+
+// NewTypedQueryFormatter creates a new TypedQueryFormatter partitioning rows
+// on the given date expression.
+func NewTypedQueryFormatter[T any](dateExpr string) *TypedQueryFormatter[T] {
+	return &TypedQueryFormatter[T]{DateExpr: dateExpr}
+}
+
+// Source returns a fully qualified bigquery table name. The period is ignored.
+func (f *TypedQueryFormatter[T]) Source(project string, config config.Config, period config.Period) string {
+	return fmt.Sprintf("%s.%s.%s", project, config.Dataset, config.Table)
+}
+
+// Partitions returns a bigquery query for listing all partitions for a given
+// source table between the period's start and end dates. Typed queries
+// partition on `date`.
+func (f *TypedQueryFormatter[T]) Partitions(source string, period config.Period) string {
+	return fmt.Sprintf(
+		`SELECT %s as date
+         FROM %s
+         WHERE %s BETWEEN DATE('%s') AND DATE('%s')
+         GROUP BY date
+         ORDER BY date`, f.DateExpr, source, f.DateExpr,
+		period.Start.Format(dateFormat), period.End.Format(dateFormat))
+}
+
+// Partition returns a date partition id based on a row returned by running the
+// Partitions() query. The partition id can be used in query templates. Typed
+// query conditions search on the Date.
+func (f *TypedQueryFormatter[T]) Partition(row map[string]bigquery.Value) string {
+	date, ok := row["date"]
+	if !ok {
+		return "0001-01-01" // a noop expression.
+	}
+	partition, ok := date.(civil.Date)
+	if !ok {
+		return "0001-01-01" // a noop expression.
+	}
+	return fmt.Sprintf("%d-%02d-%02d", partition.Year, int(partition.Month), partition.Day)
+}
+
+// Marshal converts an export query row into a byte result suitable for writing
+// to disk. The first row is marshalled to T and then to JSON.
+func (f *TypedQueryFormatter[T]) Marshal(rows []map[string]bigquery.Value) ([]byte, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("zero length record")
+	}
+	// Serialize the bigquery row to JSON. This will include empty fields.
+	j, err := json.Marshal(rows[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Load JSON into the real type.
+	var v T
+	err = json.Unmarshal(j, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serialize the actual type to JSON, which omits empty fields.
+	return json.Marshal(v)
+}
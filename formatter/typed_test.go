@@ -0,0 +1,54 @@
+package formatter
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+type testSchema struct {
+	UUID  string
+	Count int64  `json:",omitempty"`
+	Extra string `json:"-"`
+}
+
+func TestTypedQueryFormatter(t *testing.T) {
+	f := NewTypedQueryFormatter[testSchema]("DATE(date)")
+
+	period := config.Period{
+		Granularity: config.Yearly,
+		Start:       time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		End:         time.Date(2022, time.June, 30, 0, 0, 0, 0, time.UTC),
+	}
+	wantPartitions := `SELECT DATE(date) as date
+         FROM a.b.c
+         WHERE DATE(date) BETWEEN DATE('2022-01-01') AND DATE('2022-06-30')
+         GROUP BY date
+         ORDER BY date`
+	if got := f.Partitions("a.b.c", period); got != wantPartitions {
+		t.Errorf("TypedQueryFormatter.Partitions() = %v, want %v", got,
+			wantPartitions)
+	}
+
+	rows := []map[string]bigquery.Value{
+		{
+			"UUID":  "ndt-abc",
+			"Count": int64(0),
+			"Extra": "ignored",
+		},
+	}
+	got, err := f.Marshal(rows)
+	if err != nil {
+		t.Fatalf("TypedQueryFormatter.Marshal() error = %v", err)
+	}
+	if want := `{"UUID":"ndt-abc"}`; string(got) != want {
+		t.Errorf("TypedQueryFormatter.Marshal() = %s, want %s", got, want)
+	}
+
+	_, err = f.Marshal(nil)
+	if err == nil {
+		t.Errorf("TypedQueryFormatter.Marshal() expected error, got nil")
+	}
+}
@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"text/template"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/m-lab/stats-pipeline/logging"
+	"github.com/m-lab/stats-pipeline/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/googleapi"
 )
 
+var tracer = otel.Tracer("github.com/m-lab/stats-pipeline/histogram")
+
 var (
 	queryBytesProcessMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "stats_pipeline_histograms_bytes_processed",
@@ -83,10 +91,16 @@ func (t *Table) queryConfig(query string) bqiface.QueryConfig {
 }
 
 // deleteRows removes rows where dateField is within the provided range.
-func (t *Table) deleteRows(ctx context.Context, start, end time.Time) error {
+func (t *Table) deleteRows(ctx context.Context, start, end time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "histogram.deleteRows",
+		trace.WithAttributes(attribute.String("table", t.TableID())))
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
 	tpl := template.Must(template.New("query").Parse(deleteRowsTpl))
 	q := &bytes.Buffer{}
-	err := tpl.Execute(q, map[string]string{
+	err = tpl.Execute(q, map[string]string{
 		"Table":     t.DatasetID() + "." + t.TableID(),
 		"DateField": t.config.DateField,
 		"Start":     start.Format(dateFormat),
@@ -102,29 +116,92 @@ func (t *Table) deleteRows(ctx context.Context, start, end time.Time) error {
 		// without error.
 		return nil
 	}
-	log.Printf("Deleting existing histogram rows: %s\n", q.String())
+	slog.DebugContext(ctx, "deleting existing histogram rows",
+		"table", t.TableID(), "query", q.String())
+	span.SetAttributes(tracing.QueryAttributes(jobs.Labels(ctx)["config"],
+		q.String())...)
 	query := t.client.Query(q.String())
-	_, err = query.Read(ctx)
+	jobs.Configure(ctx, query, t.queryConfig(q.String()),
+		jobs.IDPrefix("delete", t.TableID(), t.DatasetID(), q.String()))
+	job, status, err := jobs.Run(ctx, query)
+	if job != nil {
+		tracing.SetJob(span, job, status)
+	}
 	if err != nil {
-		log.Printf("Warning: cannot remove previous rows (%v)", err)
+		slog.WarnContext(ctx, "cannot remove previous rows",
+			"table", t.TableID(), "error", err)
 	}
 	return err
 }
 
 // UpdateHistogram generates the histogram data for the specified time range.
 // If any data for this time range exists already, it's overwritten.
-func (t *Table) UpdateHistogram(ctx context.Context, start, end time.Time) error {
-	log.Printf("Updating table %s\n", t.TableID())
+// If a job generating the same data is still running, e.g. because a previous
+// run has crashed, it waits for that job instead of starting a new one.
+func (t *Table) UpdateHistogram(ctx context.Context, start, end time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "histogram.UpdateHistogram",
+		trace.WithAttributes(
+			attribute.String("table", t.TableID()),
+			attribute.String("start", start.Format(dateFormat)),
+			attribute.String("end", end.Format(dateFormat)),
+		))
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+	slog.InfoContext(ctx, "updating table", "table", t.TableID())
 
 	if t.config.DateField == "" || t.config.Query == "" {
 		return errors.New("the Query and DateField must be specified")
 	}
 
+	// The job ID prefix identifies the query and date range, so that a
+	// running job inserting the same rows can be found.
+	prefix := jobs.IDPrefix("histograms", t.TableID(), t.DatasetID(),
+		t.config.Query, start.Format(dateFormat), end.Format(dateFormat))
+	bqJob, err := jobs.FindRunning(ctx, t.client, prefix)
+	if err != nil {
+		// Not being able to list the jobs must not prevent the update.
+		slog.WarnContext(ctx, "cannot list running jobs",
+			"table", t.TableID(), "error", err)
+	}
+	if bqJob == nil {
+		bqJob, err = t.startUpdate(ctx, start, end, prefix)
+		if err != nil {
+			return err
+		}
+		ctx = logging.With(ctx, "job_id", bqJob.ID())
+		slog.InfoContext(ctx, "histogram query started", "table", t.TableID())
+	} else {
+		ctx = logging.With(ctx, "job_id", bqJob.ID())
+		slog.InfoContext(ctx, "reusing running histogram query",
+			"table", t.TableID())
+	}
+	status, err := jobs.Wait(ctx, bqJob)
+	tracing.SetJob(span, bqJob, status)
+	if err != nil {
+		return err
+	}
+	// Get bytes processed by the current query.
+	queryBytesProcessMetric.WithLabelValues(t.Table.FullyQualifiedName()).
+		Add(float64(status.Statistics.TotalBytesProcessed))
+	slog.InfoContext(ctx, "histogram query done", "table", t.TableID(),
+		"bytes_processed", status.Statistics.TotalBytesProcessed)
+	if status.Err() != nil {
+		return status.Err()
+	}
+	return jobs.Charge(ctx, status)
+}
+
+// startUpdate removes the rows between start and end, and starts the job
+// generating them again with the given job ID prefix.
+func (t *Table) startUpdate(ctx context.Context, start, end time.Time,
+	prefix string) (bqiface.Job, error) {
 	// Make sure there aren't multiple histograms for this date range by
 	// removing any previously inserted rows.
 	err := t.deleteRows(ctx, start, end)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Configure the histogram generation query.
@@ -160,23 +237,10 @@ func (t *Table) UpdateHistogram(ctx context.Context, start, end time.Time) error
 		},
 	}
 	query := t.client.Query(t.config.Query)
-	query.SetQueryConfig(qc)
+	jobs.Configure(ctx, query, qc, prefix)
 
 	// Run the histogram generation query.
-	log.Printf("Generating histogram data for table %s\n", t.TableID())
-	bqJob, err := query.Run(ctx)
-	if err != nil {
-		return err
-	}
-	status, err := bqJob.Wait(ctx)
-	if err != nil {
-		return err
-	}
-	// Get bytes processed by the current query.
-	queryBytesProcessMetric.WithLabelValues(t.Table.FullyQualifiedName()).
-		Add(float64(status.Statistics.TotalBytesProcessed))
-	if status.Err() != nil {
-		return status.Err()
-	}
-	return nil
+	slog.DebugContext(ctx, "generating histogram data",
+		"table", t.TableID(), "query", t.config.Query)
+	return query.Run(ctx)
 }
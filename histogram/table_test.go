@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,16 +13,30 @@ import (
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 // ***** mockClient *****
 type mockClient struct {
 	bqiface.Client
-	queryReadMustFail bool
-	queryRunMustFail  bool
-	tableMissingErr   bool
-	queries           []string
+	// deleteMustFail controls whether the Run() method fails for DELETE
+	// queries, and queryRunMustFail for every query.
+	deleteMustFail   bool
+	queryRunMustFail bool
+	tableMissingErr  bool
+	queries          []string
+	// jobIDs stores the job ID prefix of every query run through this
+	// client.
+	jobIDs []string
+	// running are the jobs listed by Jobs(), or jobsErr its error.
+	running []bqiface.Job
+	jobsErr error
 }
 
 func (c *mockClient) Dataset(name string) bqiface.Dataset {
@@ -33,13 +48,38 @@ func (c *mockClient) Dataset(name string) bqiface.Dataset {
 
 func (c *mockClient) Query(query string) bqiface.Query {
 	return &mockQuery{
-		client:       c,
-		q:            query,
-		readMustFail: c.queryReadMustFail,
-		runMustFail:  c.queryRunMustFail,
+		client: c,
+		q:      query,
+		runMustFail: c.queryRunMustFail ||
+			c.deleteMustFail && strings.HasPrefix(query, "DELETE"),
 	}
 }
 
+func (c *mockClient) Jobs(context.Context) bqiface.JobIterator {
+	return &mockJobIterator{jobs: c.running, err: c.jobsErr}
+}
+
+// ***** mockJobIterator *****
+type mockJobIterator struct {
+	bqiface.JobIterator
+	jobs []bqiface.Job
+	err  error
+}
+
+func (it *mockJobIterator) SetState(bigquery.State) {}
+
+func (it *mockJobIterator) Next() (bqiface.Job, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.jobs) == 0 {
+		return nil, iterator.Done
+	}
+	job := it.jobs[0]
+	it.jobs = it.jobs[1:]
+	return job, nil
+}
+
 // ***** mockDataset *****
 type mockDataset struct {
 	bqiface.Dataset
@@ -87,11 +127,11 @@ func (t *mockTable) Metadata(ctx context.Context) (*bigquery.TableMetadata, erro
 // ********** mockQuery **********
 type mockQuery struct {
 	bqiface.Query
-	client       *mockClient
-	q            string
-	qc           bqiface.QueryConfig
-	readMustFail bool
-	runMustFail  bool
+	client      *mockClient
+	q           string
+	qc          bqiface.QueryConfig
+	runMustFail bool
+	jobIDConfig bigquery.JobIDConfig
 }
 
 func (q *mockQuery) Run(context.Context) (bqiface.Job, error) {
@@ -100,33 +140,36 @@ func (q *mockQuery) Run(context.Context) (bqiface.Job, error) {
 	}
 	// Store the query's content into the client so it can be checked later.
 	q.client.queries = append(q.client.queries, q.q)
+	q.client.jobIDs = append(q.client.jobIDs, q.jobIDConfig.JobID)
 	return &mockJob{}, nil
 }
 
-func (q *mockQuery) Read(context.Context) (bqiface.RowIterator, error) {
-	if q.readMustFail {
-		return nil, errors.New("Read() failed")
-	}
-	// Store the query's content into the client so it can be checked later.
-	q.client.queries = append(q.client.queries, q.q)
-	return &mockRowIterator{}, nil
-}
-
 func (q *mockQuery) SetQueryConfig(qc bqiface.QueryConfig) {
 	q.qc = qc
 }
 
-// ***** mockRowIterator *****
-type mockRowIterator struct {
-	bqiface.RowIterator
+func (q *mockQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobIDConfig
 }
 
 // ***** mockJob *****
 type mockJob struct {
 	bqiface.Job
+	id           string
 	waitMustFail bool
 }
 
+func (j *mockJob) ID() string {
+	if j.id != "" {
+		return j.id
+	}
+	return "job-id"
+}
+
+func (j *mockJob) LastStatus() *bigquery.JobStatus {
+	return nil
+}
+
 func (j *mockJob) Wait(context.Context) (*bigquery.JobStatus, error) {
 	if j.waitMustFail {
 		return nil, errors.New("Wait() failed")
@@ -172,8 +215,20 @@ func TestTable_deleteRows(t *testing.T) {
 		t.Errorf("deleteRows() returned err: %v", err)
 	}
 
+	// The DELETE query's bytes are charged to the budget.
+	table = NewTable("test", "dataset", emptyConfig, &mockClient{})
+	ctx, cancel := jobs.WithBudget(context.Background(), 100)
+	defer cancel()
+	err = table.deleteRows(ctx, time.Now(), time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Errorf("deleteRows() returned err: %v", err)
+	}
+	if got := jobs.BytesProcessed(ctx); got != 10 {
+		t.Errorf("deleteRows() charged %d bytes, want 10", got)
+	}
+
 	table = NewTable("test", "dataset", emptyConfig, &mockClient{
-		queryReadMustFail: true,
+		deleteMustFail: true,
 	})
 	err = table.deleteRows(context.Background(), time.Now(), time.Now().Add(1*time.Minute))
 	if err == nil {
@@ -227,7 +282,7 @@ func TestTable_UpdateHistogram(t *testing.T) {
 				Query: "test",
 			},
 			client: &mockClient{
-				queryReadMustFail: true,
+				deleteMustFail: true,
 			},
 			wantErr: true,
 		},
@@ -266,6 +321,141 @@ func TestTable_UpdateHistogram(t *testing.T) {
 	}
 }
 
+func TestTable_UpdateHistogram_jobs(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)
+	deletePrefix := jobs.IDPrefix("delete", "test_table", "test_ds",
+		"DELETE FROM test_ds.test_table WHERE date BETWEEN \"2020-01-01\" AND \"2020-12-31\"")
+	insertPrefix := jobs.IDPrefix("histograms", "test_table", "test_ds",
+		"test", "2020-01-01", "2020-12-31")
+	tests := []struct {
+		name        string
+		client      *mockClient
+		wantQueries int
+		wantJobIDs  []string
+	}{
+		{
+			name:        "new-job",
+			client:      &mockClient{},
+			wantQueries: 2,
+			wantJobIDs:  []string{deletePrefix, insertPrefix},
+		},
+		{
+			name: "running-job",
+			client: &mockClient{
+				running: []bqiface.Job{
+					&mockJob{id: "other-job"},
+					&mockJob{id: insertPrefix + "-abc"},
+				},
+			},
+		},
+		{
+			name: "other-running-job",
+			client: &mockClient{
+				running: []bqiface.Job{&mockJob{id: "other-job"}},
+			},
+			wantQueries: 2,
+			wantJobIDs:  []string{deletePrefix, insertPrefix},
+		},
+		{
+			name: "list-failure",
+			client: &mockClient{
+				jobsErr: errors.New("Jobs() failed"),
+			},
+			wantQueries: 2,
+			wantJobIDs:  []string{deletePrefix, insertPrefix},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hist := &Table{
+				Table: tt.client.Dataset("test_ds").Table("test_table"),
+				config: QueryConfig{
+					Query:     "test",
+					DateField: "date",
+				},
+				client: tt.client,
+			}
+			if err := hist.UpdateHistogram(context.Background(), start,
+				end); err != nil {
+				t.Fatalf("UpdateHistogram() returned err: %v", err)
+			}
+			if len(tt.client.queries) != tt.wantQueries {
+				t.Errorf("UpdateHistogram() ran %v, want %d queries",
+					tt.client.queries, tt.wantQueries)
+			}
+			if !reflect.DeepEqual(tt.client.jobIDs, tt.wantJobIDs) {
+				t.Errorf("UpdateHistogram() used job IDs %v, want %v",
+					tt.client.jobIDs, tt.wantJobIDs)
+			}
+		})
+	}
+}
+
+func TestTable_UpdateHistogram_budget(t *testing.T) {
+	client := &mockClient{}
+	hist := &Table{
+		Table: client.Dataset("test_ds").Table("test_table"),
+		config: QueryConfig{
+			Query:     "test",
+			DateField: "date",
+		},
+		client: client,
+	}
+	// The mockJob processes 10 bytes.
+	ctx, cancel := jobs.WithBudget(context.Background(), 5)
+	defer cancel()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := hist.UpdateHistogram(ctx, start, start)
+	var budgetErr *jobs.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("UpdateHistogram() returned %v, want a BudgetExceededError",
+			err)
+	}
+	if ctx.Err() == nil {
+		t.Errorf("UpdateHistogram() didn't cancel the context")
+	}
+}
+
+func TestTable_UpdateHistogram_spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	client := &mockClient{}
+	hist := &Table{
+		Table: client.Dataset("test_ds").Table("test_table"),
+		config: QueryConfig{
+			Query:     "test",
+			DateField: "date",
+		},
+		client: client,
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := hist.UpdateHistogram(context.Background(), start, start)
+	if err != nil {
+		t.Fatalf("UpdateHistogram() returned err: %v", err)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "histogram.deleteRows" ||
+		spans[1].Name() != "histogram.UpdateHistogram" {
+		t.Fatalf("UpdateHistogram() recorded %v", spans)
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("deleteRows span is not a child of UpdateHistogram")
+	}
+	found := false
+	for _, kv := range spans[1].Attributes() {
+		if kv.Key == "bigquery.job_id" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("UpdateHistogram span has no job ID: %v", spans[1].Attributes())
+	}
+}
+
 func TestPrometheusMetrics(t *testing.T) {
 	queryBytesProcessMetric.WithLabelValues("x")
 
@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+)
+
+var maxBytesBilled = flag.Int64("jobs.max-bytes-billed", 0,
+	"Maximum bytes billed by a single BigQuery query, 0 for the project's default")
+
+// BudgetExceededError is the cause of the cancellation of a run's context
+// once its jobs have processed more bytes than the run's budget.
+type BudgetExceededError struct {
+	// Config is the name of the config whose job exceeded the budget.
+	Config string
+	// Used is the number of bytes processed by the run's jobs.
+	Used int64
+	// Limit is the run's budget.
+	Limit int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("byte budget exceeded by config %s: %d bytes processed, limit %d",
+		e.Config, e.Used, e.Limit)
+}
+
+// budget tracks the bytes processed by the jobs of a run.
+type budget struct {
+	mu     sync.Mutex
+	limit  int64
+	used   int64
+	cancel context.CancelCauseFunc
+}
+
+type budgetKey struct{}
+
+// WithBudget returns a copy of ctx whose jobs may process up to limit bytes in
+// total, as reported by Charge. Once the limit is exceeded, the returned
+// context is canceled with a *BudgetExceededError as its cause (see
+// context.Cause), so that the remaining work is aborted. A limit <= 0 means
+// no limit. The returned CancelFunc must be called to release the context's
+// resources.
+func WithBudget(ctx context.Context, limit int64) (context.Context,
+	context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	b := &budget{limit: limit, cancel: cancel}
+	return context.WithValue(ctx, budgetKey{}, b), func() { cancel(nil) }
+}
+
+// Charge adds the bytes processed by a completed job, according to its status,
+// to the budget attached to ctx, if any. It returns a *BudgetExceededError if
+// the budget has been exceeded, by this job or by a previous one.
+func Charge(ctx context.Context, status *bigquery.JobStatus) error {
+	b, ok := ctx.Value(budgetKey{}).(*budget)
+	if !ok || status == nil || status.Statistics == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasExceeded := b.exceeded()
+	b.used += status.Statistics.TotalBytesProcessed
+	if !b.exceeded() {
+		return nil
+	}
+	err := &BudgetExceededError{
+		Config: Labels(ctx)["config"],
+		Used:   b.used,
+		Limit:  b.limit,
+	}
+	if !wasExceeded {
+		b.cancel(err)
+	}
+	return err
+}
+
+// BytesProcessed returns the bytes processed by the jobs charged to the budget
+// attached to ctx.
+func BytesProcessed(ctx context.Context) int64 {
+	b, ok := ctx.Value(budgetKey{}).(*budget)
+	if !ok {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *budget) exceeded() bool {
+	return b.limit > 0 && b.used > b.limit
+}
@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+)
+
+func jobStatus(bytes int64) *bigquery.JobStatus {
+	return &bigquery.JobStatus{
+		Statistics: &bigquery.JobStatistics{TotalBytesProcessed: bytes},
+	}
+}
+
+func TestCharge(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int64
+		charges    []int64
+		wantUsed   int64
+		wantErrs   int
+		wantCancel bool
+	}{
+		{
+			name:     "under-budget",
+			limit:    100,
+			charges:  []int64{10, 20, 70},
+			wantUsed: 100,
+		},
+		{
+			name:       "over-budget",
+			limit:      100,
+			charges:    []int64{60, 60, 10},
+			wantUsed:   130,
+			wantErrs:   2,
+			wantCancel: true,
+		},
+		{
+			name:     "no-limit",
+			charges:  []int64{1 << 50, 1 << 50},
+			wantUsed: 1 << 51,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := WithBudget(context.Background(), tt.limit)
+			defer cancel()
+			ctx = WithLabels(ctx, "config", "test")
+			errs := 0
+			for _, c := range tt.charges {
+				if err := Charge(ctx, jobStatus(c)); err != nil {
+					errs++
+				}
+			}
+			if errs != tt.wantErrs {
+				t.Errorf("Charge() returned %d errors, want %d", errs,
+					tt.wantErrs)
+			}
+			if got := BytesProcessed(ctx); got != tt.wantUsed {
+				t.Errorf("BytesProcessed() = %d, want %d", got, tt.wantUsed)
+			}
+			if (ctx.Err() != nil) != tt.wantCancel {
+				t.Fatalf("context canceled: %v, want %v", ctx.Err(),
+					tt.wantCancel)
+			}
+			if !tt.wantCancel {
+				return
+			}
+			var budgetErr *BudgetExceededError
+			if !errors.As(context.Cause(ctx), &budgetErr) {
+				t.Fatalf("context canceled by %v, want a BudgetExceededError",
+					context.Cause(ctx))
+			}
+			want := BudgetExceededError{Config: "test", Used: 120, Limit: 100}
+			if *budgetErr != want {
+				t.Errorf("context canceled by %+v, want %+v", *budgetErr, want)
+			}
+		})
+	}
+}
+
+func TestCharge_noBudget(t *testing.T) {
+	ctx := context.Background()
+	if err := Charge(ctx, jobStatus(10)); err != nil {
+		t.Errorf("Charge() returned err: %v", err)
+	}
+	if err := Charge(ctx, nil); err != nil {
+		t.Errorf("Charge() returned err: %v", err)
+	}
+	if got := BytesProcessed(ctx); got != 0 {
+		t.Errorf("BytesProcessed() = %d, want 0", got)
+	}
+}
+
+func TestConfigure_maxBytesBilled(t *testing.T) {
+	old := *maxBytesBilled
+	*maxBytesBilled = 1000
+	defer func() { *maxBytesBilled = old }()
+
+	tests := []struct {
+		name string
+		max  int64
+		want int64
+	}{
+		{name: "default", want: 1000},
+		{name: "query-limit", max: 10, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &mockQuery{}
+			qc := bqiface.QueryConfig{}
+			qc.MaxBytesBilled = tt.max
+			Configure(context.Background(), q, qc, "prefix_")
+			if q.qc.MaxBytesBilled != tt.want {
+				t.Errorf("Configure() set MaxBytesBilled %d, want %d",
+					q.qc.MaxBytesBilled, tt.want)
+			}
+		})
+	}
+}
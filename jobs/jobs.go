@@ -0,0 +1,175 @@
+// Package jobs labels the BigQuery jobs run by the stats pipeline, so that
+// their cost can be attributed, and gives them deterministic ID prefixes, so
+// that a job still running after a crash can be found and reused.
+//
+// Labels are attached to a context with WithLabels, e.g. the run ID, config
+// name, step and year, and applied to the jobs submitted with that context
+// by Configure. Every job also has the pipeline=stats label.
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// Maximum length of a label key or value.
+	maxLabelLength = 63
+	// Maximum length of the readable part of a job ID prefix.
+	maxNameLength = 200
+	// Maximum time to wait for a job's cancellation request to succeed.
+	cancelTimeout = 30 * time.Second
+)
+
+type labelsKey struct{}
+
+// WithLabels returns a copy of ctx whose jobs have the given labels, in
+// addition to (or replacing) the ones already attached to ctx. The arguments
+// are alternating keys and values. Keys and values are converted to valid
+// BigQuery labels, i.e. lowercase letters, digits, dashes and underscores.
+func WithLabels(ctx context.Context, kv ...string) context.Context {
+	labels := Labels(ctx)
+	for i := 0; i+1 < len(kv); i += 2 {
+		labels[sanitize(kv[i], maxLabelLength)] = sanitize(kv[i+1],
+			maxLabelLength)
+	}
+	return context.WithValue(ctx, labelsKey{}, labels)
+}
+
+// Labels returns the labels of the jobs submitted with ctx.
+func Labels(ctx context.Context) map[string]string {
+	labels := map[string]string{"pipeline": "stats"}
+	if l, ok := ctx.Value(labelsKey{}).(map[string]string); ok {
+		for k, v := range l {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// IDPrefix returns the job ID prefix of a job of the given kind (e.g.
+// "histograms") for the named table, e.g. "stats_histograms_global_2020_"
+// followed by a hash of the keys and a final underscore. The keys must
+// identify the job's work, e.g. its query, parameters and dates, so that the
+// same work always has the same prefix.
+func IDPrefix(kind, name string, keys ...string) string {
+	h := sha256.New()
+	h.Write([]byte(kind + "\x00" + name))
+	for _, k := range keys {
+		h.Write([]byte("\x00" + k))
+	}
+	return "stats_" + sanitize(kind, maxNameLength) + "_" +
+		sanitize(name, maxNameLength) + "_" +
+		hex.EncodeToString(h.Sum(nil))[:16] + "_"
+}
+
+// Configure sets the query's configuration, adding the labels attached to ctx
+// and the -jobs.max-bytes-billed limit, and makes its job ID start with prefix
+// (see IDPrefix).
+func Configure(ctx context.Context, q bqiface.Query, qc bqiface.QueryConfig,
+	prefix string) {
+	labels := Labels(ctx)
+	for k, v := range qc.Labels {
+		labels[k] = v
+	}
+	qc.Labels = labels
+	if qc.MaxBytesBilled == 0 {
+		qc.MaxBytesBilled = *maxBytesBilled
+	}
+	q.SetQueryConfig(qc)
+	idConfig := q.JobIDConfig()
+	idConfig.JobID = prefix
+	idConfig.AddJobIDSuffix = true
+}
+
+// Wait waits for the job to complete. If ctx is canceled first, e.g. because
+// the run has been cancelled or has exceeded its budget, the job is canceled
+// too, and the cause of the context's cancellation is returned.
+func Wait(ctx context.Context, job bqiface.Job) (*bigquery.JobStatus, error) {
+	status, err := job.Wait(ctx)
+	if err == nil || ctx.Err() == nil {
+		return status, err
+	}
+	cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx),
+		cancelTimeout)
+	defer cancel()
+	if err := job.Cancel(cancelCtx); err != nil {
+		slog.WarnContext(ctx, "cannot cancel job", "job_id", job.ID(),
+			"error", err)
+	} else {
+		slog.InfoContext(ctx, "job cancelled", "job_id", job.ID())
+	}
+	return status, context.Cause(ctx)
+}
+
+// Run runs the query, waits for its job to complete (see Wait) and charges the
+// bytes it processed to the budget attached to ctx (see Charge). It returns
+// the job, whose results can then be read, and its final status.
+func Run(ctx context.Context, q bqiface.Query) (bqiface.Job,
+	*bigquery.JobStatus, error) {
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := Wait(ctx, job)
+	if err != nil {
+		return job, status, err
+	}
+	if status.Err() != nil {
+		return job, status, status.Err()
+	}
+	return job, status, Charge(ctx, status)
+}
+
+// FindRunning returns a job whose ID starts with prefix and that is still
+// running, or nil if there is none. Only the jobs created during the last
+// day by the current user are considered.
+func FindRunning(ctx context.Context, client bqiface.Client,
+	prefix string) (bqiface.Job, error) {
+	it := client.Jobs(ctx)
+	it.SetState(bigquery.Running)
+	minCreation := time.Now().Add(-24 * time.Hour)
+	for {
+		job, err := it.Next()
+		if err == iterator.Done {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(job.ID(), prefix) {
+			return job, nil
+		}
+		// Jobs are listed from the most recent, so older jobs can't have
+		// been created by this pipeline's previous runs.
+		if status := job.LastStatus(); status != nil &&
+			status.Statistics != nil &&
+			status.Statistics.CreationTime.Before(minCreation) {
+			return nil, nil
+		}
+	}
+}
+
+// sanitize converts s to lowercase letters, digits, dashes and underscores,
+// and truncates it to max characters.
+func sanitize(s string, max int) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' ||
+			c == '_') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return string(b)
+}
@@ -0,0 +1,419 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+)
+
+// ***** mockClient *****
+type mockClient struct {
+	bqiface.Client
+	jobs  []bqiface.Job
+	err   error
+	state bigquery.State
+}
+
+func (c *mockClient) Jobs(context.Context) bqiface.JobIterator {
+	return &mockJobIterator{client: c, jobs: c.jobs}
+}
+
+// ***** mockJobIterator *****
+type mockJobIterator struct {
+	bqiface.JobIterator
+	client *mockClient
+	jobs   []bqiface.Job
+}
+
+func (it *mockJobIterator) SetState(state bigquery.State) {
+	it.client.state = state
+}
+
+func (it *mockJobIterator) Next() (bqiface.Job, error) {
+	if it.client.err != nil {
+		return nil, it.client.err
+	}
+	if len(it.jobs) == 0 {
+		return nil, iterator.Done
+	}
+	job := it.jobs[0]
+	it.jobs = it.jobs[1:]
+	return job, nil
+}
+
+// ***** mockJob *****
+type mockJob struct {
+	bqiface.Job
+	id      string
+	created time.Time
+	// Wait blocks until its context is canceled if block is set, and
+	// returns waitErr otherwise.
+	block     bool
+	waitErr   error
+	cancelErr error
+	cancelled bool
+	// bytes is the number of bytes processed by the job.
+	bytes int64
+}
+
+func (j *mockJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	if j.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if j.waitErr != nil {
+		return nil, j.waitErr
+	}
+	return &bigquery.JobStatus{
+		State:      bigquery.Done,
+		Statistics: &bigquery.JobStatistics{TotalBytesProcessed: j.bytes},
+	}, nil
+}
+
+func (j *mockJob) Cancel(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	j.cancelled = true
+	return j.cancelErr
+}
+
+func (j *mockJob) ID() string {
+	return j.id
+}
+
+func (j *mockJob) LastStatus() *bigquery.JobStatus {
+	return &bigquery.JobStatus{
+		Statistics: &bigquery.JobStatistics{
+			CreationTime: j.created,
+		},
+	}
+}
+
+// ***** mockQuery *****
+type mockQuery struct {
+	bqiface.Query
+	qc          bqiface.QueryConfig
+	jobIDConfig bigquery.JobIDConfig
+	job         *mockJob
+	runErr      error
+}
+
+func (q *mockQuery) Run(context.Context) (bqiface.Job, error) {
+	if q.runErr != nil {
+		return nil, q.runErr
+	}
+	return q.job, nil
+}
+
+func (q *mockQuery) SetQueryConfig(qc bqiface.QueryConfig) {
+	q.qc = qc
+}
+
+func (q *mockQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobIDConfig
+}
+
+// ***** Tests *****
+func TestWithLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels [][]string
+		want   map[string]string
+	}{
+		{
+			name: "none",
+			want: map[string]string{"pipeline": "stats"},
+		},
+		{
+			name: "nested",
+			labels: [][]string{
+				{"run_id", "20200101T000000Z-0123abcd"},
+				{"step", "histograms", "config", "US_States"},
+			},
+			want: map[string]string{
+				"pipeline": "stats",
+				"run_id":   "20200101t000000z-0123abcd",
+				"step":     "histograms",
+				"config":   "us_states",
+			},
+		},
+		{
+			name: "replaced",
+			labels: [][]string{
+				{"year", "2019"},
+				{"year", "2020"},
+			},
+			want: map[string]string{"pipeline": "stats", "year": "2020"},
+		},
+		{
+			name: "sanitized",
+			labels: [][]string{
+				{"Config", "a.b/c " + strings.Repeat("x", 100)},
+			},
+			want: map[string]string{
+				"pipeline": "stats",
+				"config":   "a_b_c_" + strings.Repeat("x", 57),
+			},
+		},
+		{
+			name:   "odd-arguments",
+			labels: [][]string{{"step", "exports", "year"}},
+			want:   map[string]string{"pipeline": "stats", "step": "exports"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, kv := range tt.labels {
+				ctx = WithLabels(ctx, kv...)
+			}
+			if got := Labels(ctx); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Labels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithLabels_parent(t *testing.T) {
+	parent := WithLabels(context.Background(), "config", "a")
+	WithLabels(parent, "config", "b")
+	if got := Labels(parent)["config"]; got != "a" {
+		t.Errorf("WithLabels() modified the parent's labels: config=%s", got)
+	}
+}
+
+func TestIDPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       string
+		table      string
+		keys       []string
+		wantPrefix string
+	}{
+		{
+			name:       "histograms",
+			kind:       "histograms",
+			table:      "US_States_2020",
+			keys:       []string{"SELECT 1", "2020-01-01", "2020-12-31"},
+			wantPrefix: "stats_histograms_us_states_2020_",
+		},
+		{
+			name:       "fully-qualified-table",
+			kind:       "partitions",
+			table:      "project.dataset.table",
+			wantPrefix: "stats_partitions_project_dataset_table_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IDPrefix(tt.kind, tt.table, tt.keys...)
+			if !strings.HasPrefix(got, tt.wantPrefix) ||
+				len(got) != len(tt.wantPrefix)+17 || !strings.HasSuffix(got, "_") {
+				t.Errorf("IDPrefix() = %s, want %s<hash>_", got, tt.wantPrefix)
+			}
+			if again := IDPrefix(tt.kind, tt.table, tt.keys...); again != got {
+				t.Errorf("IDPrefix() is not deterministic: %s != %s", again, got)
+			}
+			other := IDPrefix(tt.kind, tt.table, append(tt.keys, "x")...)
+			if other == got {
+				t.Errorf("IDPrefix() is the same for different keys: %s", got)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	ctx := WithLabels(context.Background(), "step", "exports")
+	q := &mockQuery{}
+	qc := bqiface.QueryConfig{}
+	qc.Q = "SELECT 1"
+	qc.Labels = map[string]string{"extra": "label"}
+	Configure(ctx, q, qc, "stats_exports_table_0123_")
+	if q.qc.Q != "SELECT 1" {
+		t.Errorf("Configure() set query %q, want %q", q.qc.Q, "SELECT 1")
+	}
+	wantLabels := map[string]string{
+		"pipeline": "stats",
+		"step":     "exports",
+		"extra":    "label",
+	}
+	if !reflect.DeepEqual(q.qc.Labels, wantLabels) {
+		t.Errorf("Configure() set labels %v, want %v", q.qc.Labels, wantLabels)
+	}
+	wantID := bigquery.JobIDConfig{
+		JobID:          "stats_exports_table_0123_",
+		AddJobIDSuffix: true,
+	}
+	if q.jobIDConfig != wantID {
+		t.Errorf("Configure() set job ID config %v, want %v", q.jobIDConfig,
+			wantID)
+	}
+}
+
+func TestFindRunning(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		client  *mockClient
+		wantID  string
+		wantErr bool
+	}{
+		{
+			name: "found",
+			client: &mockClient{
+				jobs: []bqiface.Job{
+					&mockJob{id: "other", created: now},
+					&mockJob{id: "stats_prefix_-abc", created: now},
+				},
+			},
+			wantID: "stats_prefix_-abc",
+		},
+		{
+			name: "not-found",
+			client: &mockClient{
+				jobs: []bqiface.Job{&mockJob{id: "other", created: now}},
+			},
+		},
+		{
+			name: "too-old",
+			client: &mockClient{
+				jobs: []bqiface.Job{
+					&mockJob{id: "other", created: now.Add(-48 * time.Hour)},
+					&mockJob{id: "stats_prefix_-abc", created: now},
+				},
+			},
+		},
+		{
+			name:    "list-failure",
+			client:  &mockClient{err: errors.New("Next() failed")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := FindRunning(context.Background(), tt.client,
+				"stats_prefix_")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindRunning() error = %v, wantErr %v", err,
+					tt.wantErr)
+			}
+			if tt.client.state != bigquery.Running {
+				t.Errorf("FindRunning() listed jobs in state %v",
+					tt.client.state)
+			}
+			var id string
+			if job != nil {
+				id = job.ID()
+			}
+			if id != tt.wantID {
+				t.Errorf("FindRunning() = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	cause := errors.New("run cancelled")
+	tests := []struct {
+		name          string
+		job           *mockJob
+		cancel        bool
+		wantErr       error
+		wantCancelled bool
+	}{
+		{
+			name: "done",
+			job:  &mockJob{id: "job"},
+		},
+		{
+			name:    "failure",
+			job:     &mockJob{id: "job", waitErr: errors.New("Wait() failed")},
+			wantErr: errors.New("Wait() failed"),
+		},
+		{
+			name:          "cancelled",
+			job:           &mockJob{id: "job", block: true},
+			cancel:        true,
+			wantErr:       cause,
+			wantCancelled: true,
+		},
+		{
+			name: "cancel-failure",
+			job: &mockJob{id: "job", block: true,
+				cancelErr: errors.New("Cancel() failed")},
+			cancel:        true,
+			wantErr:       cause,
+			wantCancelled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			if tt.cancel {
+				cancel(cause)
+			}
+			_, err := Wait(ctx, tt.job)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("Wait() returned %v, want %v", err, tt.wantErr)
+			}
+			if tt.job.cancelled != tt.wantCancelled {
+				t.Errorf("Wait() canceled the job: %v, want %v",
+					tt.job.cancelled, tt.wantCancelled)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     *mockQuery
+		wantErr   bool
+		wantBytes int64
+	}{
+		{
+			name:      "done",
+			query:     &mockQuery{job: &mockJob{id: "job", bytes: 10}},
+			wantBytes: 10,
+		},
+		{
+			name:    "run-failure",
+			query:   &mockQuery{runErr: errors.New("Run() failed")},
+			wantErr: true,
+		},
+		{
+			name: "wait-failure",
+			query: &mockQuery{job: &mockJob{id: "job",
+				waitErr: errors.New("Wait() failed")}},
+			wantErr: true,
+		},
+		{
+			name:      "budget-exceeded",
+			query:     &mockQuery{job: &mockJob{id: "job", bytes: 1000}},
+			wantErr:   true,
+			wantBytes: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := WithBudget(context.Background(), 100)
+			defer cancel()
+			_, _, err := Run(ctx, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := BytesProcessed(ctx); got != tt.wantBytes {
+				t.Errorf("Run() charged %d bytes, want %d", got, tt.wantBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Package logging configures the structured logs of the stats pipeline.
+//
+// Log records are written by log/slog's default logger. Attributes identifying
+// the current unit of work, e.g. the run ID, the config name, the year or the
+// BigQuery job ID, are attached to a context with With, and added to every
+// record logged with that context (e.g. with slog.InfoContext).
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+
+	"github.com/m-lab/go/flagx"
+)
+
+var (
+	level = flagx.Enum{
+		Options: []string{"debug", "info", "warn", "error"},
+		Value:   "info",
+	}
+	format = flagx.Enum{
+		Options: []string{"json", "text"},
+		Value:   "json",
+	}
+)
+
+func init() {
+	flag.Var(&level, "logging.level",
+		"Minimum level of the logs (debug, info, warn or error)")
+	flag.Var(&format, "logging.format",
+		"Format of the logs (json or text)")
+}
+
+// Setup makes the default slog.Logger, and the log package, write records to
+// w in the format and at the level selected with -logging.format and
+// -logging.level.
+func Setup(w io.Writer) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level.Value)); err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: l, AddSource: true}
+	var h slog.Handler
+	switch format.Value {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format: %q", format.Value)
+	}
+	// The log package writes to the default handler, which records the
+	// caller if Lshortfile is set when installing it. The time and the caller
+	// are then added by the handler, not to the message.
+	log.SetFlags(log.Lshortfile)
+	slog.SetDefault(slog.New(&contextHandler{Handler: h}))
+	log.SetFlags(0)
+	return nil
+}
+
+type attrsKey struct{}
+
+// With returns a copy of ctx whose log records include the given attributes,
+// in addition to the ones already attached to ctx. The arguments are
+// key-value pairs or slog.Attr, as for slog.Logger.With.
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr{}, attrsFrom(ctx)...)
+	r := slog.Record{}
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the attributes attached to the context with With to the
+// records it handles.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs := attrsFrom(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
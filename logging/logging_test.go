@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWith(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(&contextHandler{Handler: slog.NewJSONHandler(buf, nil)})
+
+	ctx := With(context.Background(), "run_id", "run")
+	child := With(ctx, "config", "global", slog.Int("year", 2020))
+	logger.InfoContext(child, "child", "shard", 1)
+	logger.InfoContext(ctx, "parent")
+	logger.Info("none")
+
+	want := []map[string]interface{}{
+		{"msg": "child", "run_id": "run", "config": "global", "year": 2020.0,
+			"shard": 1.0},
+		{"msg": "parent", "run_id": "run"},
+		{"msg": "none"},
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d records, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("cannot parse %q: %v", line, err)
+		}
+		delete(got, "time")
+		delete(got, "level")
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("record %d = %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+
+	tests := []struct {
+		name    string
+		level   string
+		format  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "json-info",
+			level:  "info",
+			format: "json",
+			want:   []string{`"msg":"info"`, `"msg":"legacy"`, `"run_id":"run"`},
+		},
+		{
+			name:   "text-debug",
+			level:  "debug",
+			format: "text",
+			want:   []string{"msg=debug", "msg=info", "msg=legacy"},
+		},
+		{
+			name:    "invalid-level",
+			level:   "verbose",
+			format:  "json",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level.Value, format.Value = tt.level, tt.format
+			buf := &bytes.Buffer{}
+			if err := Setup(buf); (err != nil) != tt.wantErr {
+				t.Fatalf("Setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			ctx := With(context.Background(), "run_id", "run")
+			slog.DebugContext(ctx, "debug")
+			slog.InfoContext(ctx, "info")
+			log.Print("legacy")
+			for _, w := range tt.want {
+				if !strings.Contains(buf.String(), w) {
+					t.Errorf("Setup() logged %q, want %s", buf.String(), w)
+				}
+			}
+			if tt.level == "info" && strings.Contains(buf.String(), "debug") {
+				t.Errorf("Setup() logged debug records: %q", buf.String())
+			}
+		})
+	}
+}
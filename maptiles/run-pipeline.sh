@@ -2,22 +2,44 @@
 #
 # run-pipeline.sh starts stats-pipeline for the current year and then
 # generates updated maptiles.
+#
+# The step and the dates default to all the steps for the past 2 days. Jobs
+# exporting a fixed range, e.g. the annotation export, provide them.
 
 set -euxo pipefail
-ENDPOINT=${1?"Please provide the endpoint (hostname + port). Usage: $0 <endpoint>"}
+USAGE="Usage: $0 <endpoint> [<step> [<start> <end>]]"
+ENDPOINT=${1?"Please provide the endpoint (hostname + port). ${USAGE}"}
+STEP=${2:-all}
+
+# If the pipeline requires authentication, PIPELINE_TOKEN must be one of its
+# -auth.tokens or an ID token for its -auth.audience.
+auth=()
+if [[ -n "${PIPELINE_TOKEN:-}" ]]; then
+    # Don't print the token.
+    set +x
+    auth=(-H "Authorization: Bearer ${PIPELINE_TOKEN}")
+fi
 
-# Start the pipeline for the past 2 days.
-start=$(date -d "@$(( $(date +%s) - 86400 * 2 ))" +%Y-%m-%d)
-end=$(date +%Y-%m-%d)
+# Start the pipeline for the given dates, or the past 2 days.
+start=${3:-$(date -d "@$(( $(date +%s) - 86400 * 2 ))" +%Y-%m-%d)}
+end=${4:-$(date +%Y-%m-%d)}
+
+# If INCREMENTAL is "true", only the files having rows in this range are
+# exported again, instead of every file of the current year.
+params="start=${start}&end=${end}&step=${STEP}"
+if [[ "${INCREMENTAL:-}" == "true" ]]; then
+    params="${params}&incremental=true"
+fi
 
-if ! curl -X POST "http://$ENDPOINT/v0/pipeline?start=${start}&end=${end}&step=all"; then
+if ! curl ${auth[@]+"${auth[@]}"} -X POST "http://$ENDPOINT/v0/pipeline?${params}"; then
     echo "Running the pipeline failed, please check the container logs."
     exit 1
 fi
 
 echo "The pipeline completed successfully"
-# Note: this is disabled until the maptiles generation can run on multiple
-# years. Currently, 2020 is hardcoded and it would be pointless to regenerate
-# the maptiles every time the stats-pipeline runs.
+# Note: the per-year M-Lab aggregates (mlab-counties.json, mlab-tracts.json)
+# are generated by the pipeline's maptiles step under maptiles/<year>/ in the
+# statistics bucket. Building the tiles is disabled until the Makefile can use
+# them instead of downloading and processing the 2020 files.
 #export GCS_BUCKET=maptiles-${PROJECT}
 #make piecewise
@@ -2,21 +2,27 @@ package output
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/go/uploader"
 )
 
 // GCSWriter provides Write operations to a GCS bucket.
 type GCSWriter struct {
-	up *uploader.Uploader
+	up     *uploader.Uploader
+	bucket stiface.BucketHandle
 }
 
-// NewGCSWriter creates a new GCSWriter from the given uploader.Uploader.
-func NewGCSWriter(up *uploader.Uploader) *GCSWriter {
-	return &GCSWriter{up: up}
+// NewGCSWriter creates a new GCSWriter for the given bucket.
+func NewGCSWriter(client stiface.Client, bucket string) *GCSWriter {
+	return &GCSWriter{
+		up:     uploader.New(client, bucket),
+		bucket: client.Bucket(bucket),
+	}
 }
 
 // Write creates a new object at path containing content.
@@ -25,6 +31,36 @@ func (u *GCSWriter) Write(ctx context.Context, path string, content []byte) erro
 	return err
 }
 
+// NewWriter returns an io.WriteCloser streaming content to a new object at
+// path. Content is sent in chunks using a resumable upload, and the object is
+// created when the writer is closed. If ctx is canceled before, the upload is
+// aborted and Close returns an error.
+func (u *GCSWriter) NewWriter(ctx context.Context, path string) (io.WriteCloser, error) {
+	return &gcsStream{
+		ctx: ctx,
+		w:   u.bucket.Object(path).NewWriter(ctx),
+	}, nil
+}
+
+// gcsStream is a GCS object writer that fails when closed after its context
+// has been canceled.
+type gcsStream struct {
+	ctx context.Context
+	w   stiface.Writer
+}
+
+func (s *gcsStream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *gcsStream) Close() error {
+	err := s.w.Close()
+	if err == nil {
+		err = s.ctx.Err()
+	}
+	return err
+}
+
 // LocalWriter provides Write operations to a local directory.
 type LocalWriter struct {
 	dir string
@@ -45,3 +81,53 @@ func (lu *LocalWriter) Write(ctx context.Context, path string, content []byte) e
 	}
 	return ioutil.WriteFile(p, content, 0664)
 }
+
+// NewWriter returns an io.WriteCloser streaming content to a new file at
+// path. Content is written to a temporary file in the same directory, which
+// is renamed to path when the writer is closed. If ctx is canceled before,
+// the temporary file is removed and Close returns an error.
+func (lu *LocalWriter) NewWriter(ctx context.Context, path string) (io.WriteCloser, error) {
+	p := filepath.Join(lu.dir, path)
+	d := filepath.Dir(p) // path may include additional directory elements.
+	err := os.MkdirAll(d, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(d, "."+filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localStream{
+		ctx:  ctx,
+		f:    f,
+		path: p,
+	}, nil
+}
+
+// localStream is a temporary file renamed to its final path when closed.
+type localStream struct {
+	ctx  context.Context
+	f    *os.File
+	path string
+}
+
+func (s *localStream) Write(p []byte) (int, error) {
+	return s.f.Write(p)
+}
+
+func (s *localStream) Close() error {
+	err := s.f.Chmod(0664)
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(s.f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(s.f.Name())
+	}
+	return err
+}
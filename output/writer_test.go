@@ -8,7 +8,6 @@ import (
 
 	"github.com/m-lab/go/cloudtest/gcsfake"
 	"github.com/m-lab/go/testingx"
-	"github.com/m-lab/go/uploader"
 )
 
 func TestGCSWriter_Write(t *testing.T) {
@@ -33,7 +32,7 @@ func TestGCSWriter_Write(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			u := NewGCSWriter(uploader.New(client, "test_bucket"))
+			u := NewGCSWriter(client, "test_bucket")
 			if err := u.Write(context.Background(), tt.path, tt.content); (err != nil) != tt.wantErr {
 				t.Errorf("GCSWriter.Write() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -80,3 +79,74 @@ func TestLocalWriter_Write(t *testing.T) {
 		})
 	}
 }
+
+func TestGCSWriter_NewWriter(t *testing.T) {
+	client := &gcsfake.GCSClient{}
+	bucket := gcsfake.NewBucketHandle()
+	client.AddTestBucket("test_bucket", bucket)
+	u := NewGCSWriter(client, "test_bucket")
+
+	w, err := u.NewWriter(context.Background(), "output/name")
+	testingx.Must(t, err, "failed to create writer")
+	_, err = w.Write([]byte{0, 1, 2})
+	testingx.Must(t, err, "failed to write")
+	if err := w.Close(); err != nil {
+		t.Errorf("Close() returned err: %v", err)
+	}
+	if _, ok := bucket.Objs["output/name"]; !ok {
+		t.Errorf("NewWriter() didn't create the object")
+	}
+
+	// Closing a writer whose context has been canceled must fail.
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err = u.NewWriter(ctx, "output/canceled")
+	testingx.Must(t, err, "failed to create writer")
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Errorf("Close() expected err, got nil")
+	}
+}
+
+func TestLocalWriter_NewWriter(t *testing.T) {
+	dir := t.TempDir()
+	lu := NewLocalWriter(dir)
+
+	w, err := lu.NewWriter(context.Background(), "output/name")
+	testingx.Must(t, err, "failed to create writer")
+	_, err = w.Write([]byte{0, 1, 2})
+	testingx.Must(t, err, "failed to write")
+	if _, err := os.Stat(filepath.Join(dir, "output/name")); err == nil {
+		t.Errorf("NewWriter() created the file before Close()")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close() returned err: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "output/name"))
+	testingx.Must(t, err, "failed to read file")
+	if string(content) != string([]byte{0, 1, 2}) {
+		t.Errorf("NewWriter() wrote %v", content)
+	}
+
+	// Closing a writer whose context has been canceled must not create the
+	// file nor leave temporary files.
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err = lu.NewWriter(ctx, "output/canceled")
+	testingx.Must(t, err, "failed to create writer")
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Errorf("Close() expected err, got nil")
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "output"))
+	testingx.Must(t, err, "failed to read dir")
+	if len(entries) != 1 {
+		t.Errorf("NewWriter() left unexpected files: %v", entries)
+	}
+
+	// Creating a file where a directory should be must fail.
+	f, err := os.Create(filepath.Join(dir, "file"))
+	testingx.Must(t, err, "failed to create file")
+	f.Close()
+	if _, err := lu.NewWriter(context.Background(), "file/name"); err == nil {
+		t.Errorf("NewWriter() expected err, got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+// CheckDependencies checks that every config's DependsOn only refers to
+// existing configs and that there are no dependency cycles.
+func CheckDependencies(configs map[string]config.Config) error {
+	_, err := sortConfigs(configs)
+	return err
+}
+
+// sortConfigs returns the config names in topological order, i.e. every
+// config comes after the configs it depends on. Configs that could run in any
+// order are sorted by name, so that the result is deterministic.
+func sortConfigs(configs map[string]config.Config) ([]string, error) {
+	// Count the dependencies of each config and build the reverse edges.
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for name, c := range configs {
+		pending[name] = len(c.DependsOn)
+		for _, dep := range c.DependsOn {
+			if _, ok := configs[dep]; !ok {
+				return nil, fmt.Errorf("config %s depends on unknown config %s",
+					name, dep)
+			}
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+	// Repeatedly pick the configs whose dependencies are all sorted already.
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	var sorted []string
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, name)
+		for _, d := range dependents[name] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if len(sorted) != len(configs) {
+		var cycle []string
+		for name, n := range pending {
+			if n > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependency cycle between configs: %v", cycle)
+	}
+	return sorted, nil
+}
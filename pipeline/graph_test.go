@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/stats-pipeline/config"
+)
+
+func Test_sortConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs map[string]config.Config
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "no-dependencies",
+			configs: map[string]config.Config{
+				"c": {},
+				"a": {},
+				"b": {},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "dependencies",
+			configs: map[string]config.Config{
+				"global":         {DependsOn: []string{"continents"}},
+				"continents":     {},
+				"continents_asn": {DependsOn: []string{"continents"}},
+				"countries":      {},
+				"countries_asn":  {DependsOn: []string{"countries", "continents_asn"}},
+			},
+			want: []string{"continents", "continents_asn", "countries",
+				"countries_asn", "global"},
+		},
+		{
+			name: "unknown-dependency",
+			configs: map[string]config.Config{
+				"a": {DependsOn: []string{"missing"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "cycle",
+			configs: map[string]config.Config{
+				"a": {DependsOn: []string{"c"}},
+				"b": {DependsOn: []string{"a"}},
+				"c": {DependsOn: []string{"b"}},
+				"d": {},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sortConfigs(tt.configs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sortConfigs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortConfigs() = %v, want %v", got, tt.want)
+			}
+			if err := CheckDependencies(tt.configs); (err != nil) != tt.wantErr {
+				t.Errorf("CheckDependencies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
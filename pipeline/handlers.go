@@ -1,24 +1,54 @@
 package pipeline
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/m-lab/stats-pipeline/config"
 	"github.com/m-lab/stats-pipeline/histogram"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/m-lab/stats-pipeline/logging"
+	"github.com/m-lab/stats-pipeline/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const dateFormat = "2006-01-02"
 
+var tracer = otel.Tracer("github.com/m-lab/stats-pipeline/pipeline")
+
 var (
+	// Number of goroutines for updating histogram tables.
+	nHistogramWorkers = flag.Int("pipeline.histogram-workers", 4,
+		"Number of histogram tables to update in parallel")
+
+	// Maximum bytes processed by the BigQuery jobs of a run.
+	maxBytesPerRun = flag.Int64("pipeline.max-bytes-per-run", 0,
+		"Maximum bytes processed by the BigQuery jobs of a run, 0 for no limit")
+
+	// SQL expressions giving the date of a sampled row for each granularity.
+	rollupDates = map[string]string{
+		"":             "date",
+		config.Daily:   "date",
+		config.Weekly:  "DATE_TRUNC(date, ISOWEEK)",
+		config.Monthly: "DATE_TRUNC(date, MONTH)",
+		config.Yearly:  "DATE_TRUNC(date, YEAR)",
+	}
+
 	newHistogramTable = func(name, ds string, config histogram.QueryConfig,
 		client bqiface.Client) HistogramTable {
 		return histogram.NewTable(name, ds, config, client)
@@ -32,16 +62,23 @@ type HistogramTable interface {
 
 // Exporter is a configurable data exporter.
 type Exporter interface {
-	Export(context.Context, config.Config, *template.Template, int) error
+	Export(context.Context, config.Config, *template.Template, config.Period, bool) error
+}
+
+// MaptilesGenerator generates the per-year aggregates used by map tiles.
+type MaptilesGenerator interface {
+	Generate(context.Context, config.Config, *template.Template, config.Period) error
 }
 
 // Handler is the handler for /v0/pipeline.
 type Handler struct {
-	bqClient bqiface.Client
-	exporter Exporter
-	configs  map[string]config.Config
+	bqClient  bqiface.Client
+	exporters map[string]Exporter
+	maptiles  MaptilesGenerator
+	configs   map[string]config.Config
 
 	pipelineCanRun chan bool
+	runs           runs
 }
 
 type pipelineStep string
@@ -49,11 +86,14 @@ type pipelineStep string
 const (
 	histogramsStep pipelineStep = "histograms"
 	exportsStep    pipelineStep = "exports"
+	maptilesStep   pipelineStep = "maptiles"
 )
 
 type pipelineResult struct {
+	RunID          string `json:",omitempty"`
 	CompletedSteps []pipelineStep
 	Errors         []string
+	BytesProcessed int64
 }
 
 func newPipelineResult() pipelineResult {
@@ -63,14 +103,16 @@ func newPipelineResult() pipelineResult {
 	}
 }
 
-// NewHandler returns a new Handler.
-func NewHandler(bqClient bqiface.Client, exporter Exporter,
-	config map[string]config.Config) *Handler {
+// NewHandler returns a new Handler. The exporters map must have an exporter
+// for each config name.
+func NewHandler(bqClient bqiface.Client, exporters map[string]Exporter,
+	maptiles MaptilesGenerator, config map[string]config.Config) *Handler {
 	pipelineCanRun := make(chan bool, 1)
 	pipelineCanRun <- true
 	return &Handler{
 		bqClient:       bqClient,
-		exporter:       exporter,
+		exporters:      exporters,
+		maptiles:       maptiles,
 		configs:        config,
 		pipelineCanRun: pipelineCanRun,
 	}
@@ -78,17 +120,21 @@ func NewHandler(bqClient bqiface.Client, exporter Exporter,
 
 // ServeHTTP handles requests to the /pipeline endpoint.
 // This endpoint runs the entire statistics generation pipeline for the
-// provided year, i.e. every configured histogram table is updated and every
-// configured exporting task is run.
+// provided dates, i.e. every configured histogram table is updated, every
+// configured exporting task is run and the map tiles aggregates are generated.
 //
 // The querystring parameters are:
-// - year (mandatory): the year to generate statistics for.
-// - step: specify which step of the pipeline to run (histograms or exports).
-//   A value of "all" runs all the steps.
+//   - start (mandatory): the first date to generate statistics for.
+//   - end (mandatory): the last date to generate statistics for.
+//   - step (mandatory): specify which step of the pipeline to run (histograms,
+//     exports or maptiles). A value of "all" runs all the steps.
+//   - incremental: if "true", only export the files having rows between the
+//     start and end dates.
 //
-// This endpoint accepts only POST requests.
+// This endpoint accepts only POST requests. The result includes the run's ID,
+// which can be used to cancel it through the endpoints returned by Runs.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer log.Print("handler exited")
+	defer slog.DebugContext(r.Context(), "handler exited")
 	w.Header().Set("Content-Type", "application/json")
 
 	result := newPipelineResult()
@@ -143,10 +189,46 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(result)
 		return
 	}
-	// Run the pipeline.
-	result, err = h.runPipeline(r.Context(), step, startTime, endTime)
+	incremental := r.URL.Query().Get("incremental") == "true"
+	// Run the pipeline. Every log record and BigQuery job of this run has its
+	// run ID.
+	runID := newRunID()
+	ctx := logging.With(r.Context(), "run_id", runID)
+	ctx = jobs.WithLabels(ctx, "run_id", runID)
+	// Abort the run once its jobs have processed too many bytes.
+	ctx, cancel := jobs.WithBudget(ctx, *maxBytesPerRun)
+	defer cancel()
+	// Record the run, so that it can be listed and cancelled.
+	ctx, run := h.runs.start(ctx, runStatus{
+		ID:          runID,
+		Step:        step,
+		Start:       start,
+		End:         end,
+		Incremental: incremental,
+	})
+	runningMetric.Set(1)
+	runStart := time.Now()
+	result, err = h.runPipeline(ctx, step, startTime, endTime, incremental)
+	result.RunID = runID
+	result.BytesProcessed = jobs.BytesProcessed(ctx)
 	if err != nil {
 		result.Errors = append(result.Errors, err.Error())
+	}
+	status := h.runs.finish(ctx, run, result)
+	slog.InfoContext(ctx, "pipeline run finished", "status", status)
+	runDurationHistogram.WithLabelValues(step).Observe(
+		time.Since(runStart).Seconds())
+	runningMetric.Set(0)
+	switch status {
+	case runSucceeded:
+		runsTotal.WithLabelValues(step, "success").Inc()
+		lastSuccessMetric.WithLabelValues(step).SetToCurrentTime()
+	case runCancelled:
+		runsTotal.WithLabelValues(step, "cancelled").Inc()
+	default:
+		runsTotal.WithLabelValues(step, "failure").Inc()
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(result)
 		return
@@ -158,85 +240,305 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // runPipeline runs the entire statistics generation pipeline for the provided
 // start / end dates.
 func (h *Handler) runPipeline(ctx context.Context, step string,
-	start, end time.Time) (pipelineResult, error) {
-	result := newPipelineResult()
+	start, end time.Time, incremental bool) (result pipelineResult, err error) {
+	ctx, span := tracer.Start(ctx, "pipeline.runPipeline",
+		trace.WithAttributes(
+			attribute.String("step", step),
+			attribute.String("start", start.Format(dateFormat)),
+			attribute.String("end", end.Format(dateFormat)),
+			attribute.Bool("incremental", incremental),
+		))
+	defer func() {
+		span.SetAttributes(attribute.Int("errors", len(result.Errors)))
+		tracing.SetError(span, err)
+		span.End()
+	}()
+	result = newPipelineResult()
 
-	// Get all the yearly ranges between the start and end date.
-	// Since output tables are per year, if the start and end dates
-	// are in different years, we need to update the table for each
-	// year.
-	ranges := getYearlyRanges(start, end)
+	// Sort the configs so that dependencies are processed first.
+	names, err := sortConfigs(h.configs)
+	if err != nil {
+		return result, err
+	}
 
 	if step == "all" || step == "histograms" {
 		// Update all the histogram tables.
-		for name, config := range h.configs {
+		stepStart := time.Now()
+		ctx := jobs.WithLabels(ctx, "step", string(histogramsStep))
+		errs := h.updateHistograms(ctx, start, end)
+		result.Errors = append(result.Errors, errs...)
+		if ctx.Err() != nil {
+			// If the request's context has been canceled, we must
+			// return here.
+			return result, context.Cause(ctx)
+		}
+		stepDurationHistogram.WithLabelValues(string(histogramsStep)).Observe(
+			time.Since(stepStart).Seconds())
+		result.CompletedSteps = append(result.CompletedSteps, histogramsStep)
+	}
+
+	if step == "all" || step == "exports" {
+		// Export data to GCS.
+		stepStart := time.Now()
+		ctx := jobs.WithLabels(ctx, "step", string(exportsStep))
+		for _, name := range names {
+			config := h.configs[name]
+			ctx := logging.With(ctx, "config", name)
+			ctx = jobs.WithLabels(ctx, "config", name)
+			exportStart, exportEnd, err := getExportDates(start, end, config)
+			if err != nil {
+				slog.ErrorContext(ctx, "cannot export", "error", err)
+				result.Errors = append(result.Errors, fmt.Sprintf(
+					"Error while exporting %s: %v", config.Table, err))
+				failuresTotal.WithLabelValues(name, string(exportsStep)).Inc()
+				continue
+			}
+			if exportStart.After(exportEnd) {
+				slog.InfoContext(ctx,
+					"skipping export: no dates within bounds")
+				continue
+			}
+			ranges, err := getConfigRanges(exportStart, exportEnd, config)
+			if err != nil {
+				slog.ErrorContext(ctx, "cannot export", "error", err)
+				result.Errors = append(result.Errors, fmt.Sprintf(
+					"Error while exporting %s: %v", config.Table, err))
+				failuresTotal.WithLabelValues(name, string(exportsStep)).Inc()
+				continue
+			}
 			for _, r := range ranges {
 				if ctx.Err() != nil {
 					// If the request's context has been canceled, we must
 					// return here.
-					return result, ctx.Err()
+					return result, context.Cause(ctx)
 				}
-				rangeStart := r[0]
-				rangeEnd := r[1]
-
-				log.Printf("Updating histogram table %s between %s and %s...",
-					name, rangeStart, rangeEnd)
-				err := h.runQueryBetweenDates(ctx, config, rangeStart, rangeEnd)
+				ctx := logging.With(ctx, "year", r.Start.Year())
+				ctx = jobs.WithLabels(ctx, "year", strconv.Itoa(r.Start.Year()))
+				slog.InfoContext(ctx, "exporting", "period", r.Suffix())
+				err := h.exportPeriod(ctx, name, config, r, incremental)
 				if err != nil {
-					// If one of the histogram queries fail, we still want to
-					// try the remaining ones for this range.
-					log.Printf("Cannot update histogram %s: %v", name, err)
-					result.Errors = append(result.Errors,
-						fmt.Sprintf("Cannot update histogram %s: %v", name, err))
-					continue
+					slog.ErrorContext(ctx, "cannot export", "error", err)
+					result.Errors = append(result.Errors, fmt.Sprintf(
+						"Error while exporting %s: %v", config.Table, err))
+					failuresTotal.WithLabelValues(name,
+						string(exportsStep)).Inc()
 				}
 			}
-
 		}
-		result.CompletedSteps = append(result.CompletedSteps, histogramsStep)
+		if ctx.Err() != nil {
+			// If the run has been canceled during the last unit of this
+			// step, we must return here.
+			return result, context.Cause(ctx)
+		}
+		stepDurationHistogram.WithLabelValues(string(exportsStep)).Observe(
+			time.Since(stepStart).Seconds())
+		result.CompletedSteps = append(result.CompletedSteps, exportsStep)
 	}
 
-	if step == "all" || step == "exports" {
-		// Export data to GCS.
-		for name, config := range h.configs {
+	if step == "all" || step == "maptiles" {
+		// Generate the map tiles aggregates. These are always per year, even
+		// if the histogram tables have a shorter period.
+		stepStart := time.Now()
+		ctx := jobs.WithLabels(ctx, "step", string(maptilesStep))
+		ranges, _ := getRanges(start, end, config.Yearly)
+		for _, name := range names {
+			config := h.configs[name]
+			if config.MaptilesQueryFile == "" {
+				continue
+			}
+			ctx := logging.With(ctx, "config", name)
+			ctx = jobs.WithLabels(ctx, "config", name)
 			for _, r := range ranges {
-				year := r[0].Year()
 				if ctx.Err() != nil {
 					// If the request's context has been canceled, we must
 					// return here.
-					return result, ctx.Err()
+					return result, context.Cause(ctx)
 				}
-				log.Printf("Exporting %s for year %d...", name, year)
-				err := h.exportYear(ctx, config, end.Year())
+				ctx := logging.With(ctx, "year", r.Year())
+				ctx = jobs.WithLabels(ctx, "year", strconv.Itoa(r.Year()))
+				slog.InfoContext(ctx, "generating maptiles")
+				err := h.generateMaptiles(ctx, config, r)
 				if err != nil {
-					log.Printf("Error while exporting %s: %v",
-						config.Table, err)
+					slog.ErrorContext(ctx, "cannot generate maptiles",
+						"error", err)
 					result.Errors = append(result.Errors, fmt.Sprintf(
-						"Error while exporting %s: %v", config.Table, err))
+						"Error while generating maptiles for %s: %v",
+						config.Table, err))
+					failuresTotal.WithLabelValues(name,
+						string(maptilesStep)).Inc()
 				}
 			}
 		}
-		result.CompletedSteps = append(result.CompletedSteps, exportsStep)
+		if ctx.Err() != nil {
+			// If the run has been canceled during the last unit of this
+			// step, we must return here.
+			return result, context.Cause(ctx)
+		}
+		stepDurationHistogram.WithLabelValues(string(maptilesStep)).Observe(
+			time.Since(stepStart).Seconds())
+		result.CompletedSteps = append(result.CompletedSteps, maptilesStep)
 	}
 
 	return result, nil
 }
 
+// updateHistograms updates the histogram tables for every config, in an order
+// satisfying the configs' DependsOn. Configs not depending on each other are
+// updated in parallel, up to -pipeline.histogram-workers at a time. If
+// updating a config fails, the configs depending on it are skipped.
+// It returns the errors that occurred, if any.
+func (h *Handler) updateHistograms(ctx context.Context,
+	start, end time.Time) []string {
+	var mu sync.Mutex
+	var errs []string
+	failed := map[string]bool{}
+
+	// Each config's channel is closed once it has been processed.
+	done := map[string]chan struct{}{}
+	for name := range h.configs {
+		done[name] = make(chan struct{})
+	}
+	sem := make(chan struct{}, *nHistogramWorkers)
+	wg := sync.WaitGroup{}
+	for name, c := range h.configs {
+		wg.Add(1)
+		go func(name string, c config.Config) {
+			defer wg.Done()
+			defer close(done[name])
+			ctx := logging.With(ctx, "config", name)
+			ctx = jobs.WithLabels(ctx, "config", name)
+
+			// Wait for all the dependencies to be processed.
+			for _, dep := range c.DependsOn {
+				select {
+				case <-done[dep]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			mu.Lock()
+			for _, dep := range c.DependsOn {
+				if failed[dep] {
+					failed[name] = true
+					slog.WarnContext(ctx, "skipping histogram: dependency failed",
+						"dependency", dep)
+					errs = append(errs, fmt.Sprintf(
+						"Skipping histogram %s: %s failed", name, dep))
+					failuresTotal.WithLabelValues(name,
+						string(histogramsStep)).Inc()
+					mu.Unlock()
+					return
+				}
+			}
+			mu.Unlock()
+
+			// Wait for a free worker.
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			updateStart := time.Now()
+			updateErrs := h.updateHistogram(ctx, name, c, start, end)
+			histogramDurationHistogram.WithLabelValues(name).Observe(
+				time.Since(updateStart).Seconds())
+			<-sem
+
+			mu.Lock()
+			if len(updateErrs) > 0 {
+				failed[name] = true
+				errs = append(errs, updateErrs...)
+				failuresTotal.WithLabelValues(name,
+					string(histogramsStep)).Inc()
+			}
+			mu.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+	return errs
+}
+
+// updateHistogram updates the histogram table(s) for a single config between
+// the start and end dates. It returns the errors that occurred, if any.
+func (h *Handler) updateHistogram(ctx context.Context, name string,
+	config config.Config, start, end time.Time) []string {
+	var errs []string
+	// Get all the ranges between the start and end date. Since output tables
+	// are per period (e.g. per year), if the start and end dates are in
+	// different periods, we need to update the table for each period.
+	// For rollups, the ranges cover complete weeks, months or years.
+	ranges, err := getConfigRanges(start, end, config)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot update histogram", "error", err)
+		return append(errs,
+			fmt.Sprintf("Cannot update histogram %s: %v", name, err))
+	}
+	for _, r := range ranges {
+		if ctx.Err() != nil {
+			// If the request's context has been canceled, we must
+			// return here.
+			return errs
+		}
+
+		ctx := logging.With(ctx, "year", r.Start.Year())
+		ctx = jobs.WithLabels(ctx, "year", strconv.Itoa(r.Start.Year()))
+		slog.InfoContext(ctx, "updating histogram table",
+			"start", r.Start.Format(dateFormat),
+			"end", r.End.Format(dateFormat))
+		err := h.runQueryBetweenDates(ctx, config, r)
+		if err != nil {
+			// If one of the histogram queries fail, we still want to
+			// try the remaining ones for this range.
+			slog.ErrorContext(ctx, "cannot update histogram", "error", err)
+			errs = append(errs,
+				fmt.Sprintf("Cannot update histogram %s: %v", name, err))
+			continue
+		}
+	}
+	return errs
+}
+
 // runQueryBetweenDates reads the query file and runs the query for the given
-// start and end dates.
+// period's start and end dates.
 func (h *Handler) runQueryBetweenDates(ctx context.Context,
-	config config.Config, start, end time.Time) error {
+	config config.Config, period config.Period) (err error) {
+	ctx, span := tracer.Start(ctx, "pipeline.runQueryBetweenDates",
+		trace.WithAttributes(
+			attribute.String("table", config.Table),
+			attribute.String("start", period.Start.Format(dateFormat)),
+			attribute.String("end", period.End.Format(dateFormat)),
+		))
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
 	// Read query file
 	content, err := ioutil.ReadFile(config.HistogramQueryFile)
 	if err != nil {
 		return fmt.Errorf("cannot read query file %s: %v",
 			config.HistogramQueryFile, err)
 	}
-	// Append year to the table name.
-	table := fmt.Sprintf("%s_%d", config.Table, end.Year())
+	// Render the query template with the rollup's date expression.
+	rollupDate, ok := rollupDates[config.Granularity]
+	if !ok {
+		return fmt.Errorf("invalid granularity: %q", config.Granularity)
+	}
+	tpl, err := template.New(config.Table).Parse(string(content))
+	if err != nil {
+		return err
+	}
+	var query bytes.Buffer
+	err = tpl.Execute(&query, map[string]string{
+		"rollupDate": rollupDate,
+	})
+	if err != nil {
+		return err
+	}
+	// Append the period suffix to the table name.
+	table := fmt.Sprintf("%s_%s", config.Table, period.Suffix())
 	// Configure the histogram query runner.
 	queryConfig := histogram.QueryConfig{
-		Query:          string(content),
+		Query:          query.String(),
 		DateField:      config.DateField,
 		PartitionField: config.PartitionField,
 		PartitionType:  config.PartitionType,
@@ -244,7 +546,7 @@ func (h *Handler) runQueryBetweenDates(ctx context.Context,
 
 	output := newHistogramTable(table, config.Dataset, queryConfig,
 		h.bqClient)
-	err = output.UpdateHistogram(ctx, start, end)
+	err = output.UpdateHistogram(ctx, period.Start, period.End)
 	if err != nil {
 		return fmt.Errorf("cannot update histogram table %s: %v",
 			table, err)
@@ -252,22 +554,51 @@ func (h *Handler) runQueryBetweenDates(ctx context.Context,
 	return nil
 }
 
-// exportYear runs the exporter for the given year.
-func (h *Handler) exportYear(ctx context.Context, config config.Config,
-	year int) error {
+// exportPeriod runs the exporter for the given period. If incremental is true,
+// only the files having rows within the period's start and end are exported.
+func (h *Handler) exportPeriod(ctx context.Context, name string,
+	config config.Config, period config.Period, incremental bool) error {
+	exp, ok := h.exporters[name]
+	if !ok {
+		return fmt.Errorf("no exporter configured for %s", name)
+	}
 	// Read query file
 	content, err := ioutil.ReadFile(config.ExportQueryFile)
 	if err != nil {
 		return fmt.Errorf("cannot read export query file %s: %v",
 			config.ExportQueryFile, err)
 	}
-	// Append year to the table name.
-	table := fmt.Sprintf("%s_%d", config.Table, year)
+	// Append the period suffix to the table name.
+	table := fmt.Sprintf("%s_%s", config.Table, period.Suffix())
 	// Create template based on the export query file.
 	selectTpl := template.Must(template.New(table).
 		Option("missingkey=zero").Parse(string(content)))
-	// Run the exporter for the given year.
-	return h.exporter.Export(ctx, config, selectTpl, year)
+	// Run the exporter for the given period.
+	return exp.Export(ctx, config, selectTpl, period, incremental)
+}
+
+// generateMaptiles runs the maptiles generator for the given yearly period.
+func (h *Handler) generateMaptiles(ctx context.Context, config config.Config,
+	period config.Period) error {
+	// Read query file
+	content, err := ioutil.ReadFile(config.MaptilesQueryFile)
+	if err != nil {
+		return fmt.Errorf("cannot read maptiles query file %s: %v",
+			config.MaptilesQueryFile, err)
+	}
+	tpl, err := template.New(config.Table).Parse(string(content))
+	if err != nil {
+		return err
+	}
+	return h.maptiles.Generate(ctx, config, tpl, period)
+}
+
+// newRunID returns a new ID identifying a pipeline run, made of the run's start
+// time and a random suffix.
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405Z"), b)
 }
 
 // ValidateDates checks that the start and end dates are valid and returns
@@ -287,36 +618,84 @@ func ValidateDates(start, end string) (time.Time, time.Time, error) {
 	return startTime, endTime, nil
 }
 
-// getYearlyRanges splits the start/end range into one or more per-year ranges.
-// For example, if the start date is 2017-01-01 and the end date is 2017-12-31,
-// this function will return a slice with a single range of 2017-01-01 to
-// 2017-12-31. If the start date is 2017-01-01 and the end date is 2018-07-01,
-// this function will return a slice with two ranges of 2017-01-01 to 2017-12-31
-// and 2018-01-01 to 2018-07-01.
-func getYearlyRanges(start, end time.Time) [][]time.Time {
-	var ranges [][]time.Time
-	if start.Year() == end.Year() {
-		// If the start and end dates are in the same year, we only need one
-		// range.
-		ranges = append(ranges, []time.Time{start, end})
-	} else {
-		// If the start and end dates are in different years, we need a range
-		// for each year.
-		// We start by adding the first year.
-		ranges = append(ranges, []time.Time{start, time.Date(start.Year(),
-			12, 31, 0, 0, 0, 0, time.UTC)})
-
-		// Then we add the remaining years. If the start and end years are
-		// adjacent, this loop won't do anything.
-		for year := start.Year() + 1; year < end.Year(); year++ {
-			ranges = append(ranges, []time.Time{time.Date(year, 1, 1, 0, 0, 0,
-				0, time.UTC), time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)})
+// getExportDates clips the start and end dates to the config's export bounds,
+// if any. If the dates and the bounds do not overlap, the returned start is
+// after the returned end.
+func getExportDates(start, end time.Time, c config.Config) (time.Time, time.Time, error) {
+	if c.ExportStartDate != "" {
+		bound, err := time.Parse(dateFormat, c.ExportStartDate)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid export start date: %v", err)
+		}
+		if bound.After(start) {
+			start = bound
+		}
+	}
+	if c.ExportEndDate != "" {
+		bound, err := time.Parse(dateFormat, c.ExportEndDate)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid export end date: %v", err)
+		}
+		if bound.Before(end) {
+			end = bound
 		}
+	}
+	return start, end, nil
+}
 
-		// Finally, we add the last year.
-		ranges = append(ranges, []time.Time{time.Date(end.Year(), 1, 1, 0, 0, 0,
-			0, time.UTC), end})
+// getConfigRanges returns the ranges to process for the given config between
+// the start and end dates, each falling within a single table period. For
+// rollups (see config.Granularity), the ranges are extended to complete weeks,
+// months or years, and each rollup belongs to the table period containing its
+// first day.
+func getConfigRanges(start, end time.Time, c config.Config) ([]config.Period, error) {
+	if c.Granularity == "" || c.Granularity == config.Daily {
+		return getRanges(start, end, c.Period)
+	}
+	var ranges []config.Period
+	for cur := start; !cur.After(end); {
+		rollupStart, rollupEnd, err := config.RollupOf(cur, c.Granularity)
+		if err != nil {
+			return nil, err
+		}
+		p, err := config.PeriodOf(rollupStart, c.Period)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Suffix() == p.Suffix() {
+			// Extend the previous range if it's in the same table period.
+			ranges[n-1].End = rollupEnd
+		} else {
+			p.Start = rollupStart
+			p.End = rollupEnd
+			ranges = append(ranges, p)
+		}
+		cur = rollupEnd.AddDate(0, 0, 1)
+	}
+	return ranges, nil
+}
 
+// getRanges splits the start/end range into one or more ranges, each falling
+// within a single period of the given granularity (see config.Period).
+// For example, with a yearly granularity, if the start date is 2017-01-01 and
+// the end date is 2017-12-31, this function will return a slice with a single
+// range of 2017-01-01 to 2017-12-31. If the start date is 2017-01-01 and the
+// end date is 2018-07-01, this function will return a slice with two ranges of
+// 2017-01-01 to 2017-12-31 and 2018-01-01 to 2018-07-01.
+func getRanges(start, end time.Time, granularity string) ([]config.Period, error) {
+	var ranges []config.Period
+	for cur := start; !cur.After(end); {
+		p, err := config.PeriodOf(cur, granularity)
+		if err != nil {
+			return nil, err
+		}
+		// The first and last range may be shorter than the full period.
+		p.Start = cur
+		if end.Before(p.End) {
+			p.End = end
+		}
+		ranges = append(ranges, p)
+		cur = p.End.AddDate(0, 0, 1)
 	}
-	return ranges
+	return ranges, nil
 }
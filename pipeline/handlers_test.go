@@ -4,17 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"text/template"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/stats-pipeline/config"
 	"github.com/m-lab/stats-pipeline/histogram"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type mockClient struct {
@@ -23,13 +31,24 @@ type mockClient struct {
 
 type mockExporter struct{}
 
-type mockHistogramTable struct{}
+type mockHistogramTable struct {
+	mustFail bool
+}
+
+type mockMaptiles struct{}
 
-func (ex *mockExporter) Export(context.Context, config.Config, *template.Template, int) error {
+func (m *mockMaptiles) Generate(context.Context, config.Config, *template.Template, config.Period) error {
+	return nil
+}
+
+func (ex *mockExporter) Export(context.Context, config.Config, *template.Template, config.Period, bool) error {
 	return nil
 }
 
 func (h *mockHistogramTable) UpdateHistogram(context.Context, time.Time, time.Time) error {
+	if h.mustFail {
+		return errors.New("UpdateHistogram() failed")
+	}
 	return nil
 }
 
@@ -55,22 +74,22 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		w          http.ResponseWriter
 		r          *http.Request
 		bqClient   bqiface.Client
-		exporter   Exporter
+		exporters  map[string]Exporter
 		config     map[string]config.Config
 		statusCode int
 		response   *pipelineResult
 	}{
 		{
-			name:     "ok",
-			bqClient: mc,
-			exporter: me,
-			config:   conf,
+			name:      "ok",
+			bqClient:  mc,
+			exporters: map[string]Exporter{"test": me},
+			config:    conf,
 			r: httptest.NewRequest(http.MethodPost,
 				"/v0/pipeline?start=2021-01-01&end=2021-12-31&step=all",
 				bytes.NewReader([]byte{})),
 			statusCode: http.StatusOK,
 			response: &pipelineResult{
-				CompletedSteps: []pipelineStep{histogramsStep, exportsStep},
+				CompletedSteps: []pipelineStep{histogramsStep, exportsStep, maptilesStep},
 				Errors:         []string{},
 			},
 		},
@@ -134,12 +153,45 @@ func TestHandler_ServeHTTP(t *testing.T) {
 				Errors:         []string{},
 			},
 		},
+		{
+			name:       "action-exports-incremental",
+			r:          httptest.NewRequest(http.MethodPost, "/v0/pipeline?start=2021-01-01&end=2021-12-31&step=exports&incremental=true", bytes.NewReader([]byte{})),
+			statusCode: http.StatusOK,
+			response: &pipelineResult{
+				CompletedSteps: []pipelineStep{exportsStep},
+				Errors:         []string{},
+			},
+		},
+		{
+			name:     "action-exports-missing-exporter",
+			bqClient: mc,
+			config:   conf,
+			r: httptest.NewRequest(http.MethodPost,
+				"/v0/pipeline?start=2021-01-01&end=2021-12-31&step=exports",
+				bytes.NewReader([]byte{})),
+			statusCode: http.StatusOK,
+			response: &pipelineResult{
+				CompletedSteps: []pipelineStep{exportsStep},
+				Errors: []string{
+					"Error while exporting testtable: no exporter configured for test",
+				},
+			},
+		},
+		{
+			name:       "action-maptiles",
+			r:          httptest.NewRequest(http.MethodPost, "/v0/pipeline?start=2021-01-01&end=2021-12-31&step=maptiles", bytes.NewReader([]byte{})),
+			statusCode: http.StatusOK,
+			response: &pipelineResult{
+				CompletedSteps: []pipelineStep{maptilesStep},
+				Errors:         []string{},
+			},
+		},
 		{
 			name:       "action-all",
 			r:          httptest.NewRequest(http.MethodPost, "/v0/pipeline?start=2021-01-01&end=2021-12-31&step=all", bytes.NewReader([]byte{})),
 			statusCode: http.StatusOK,
 			response: &pipelineResult{
-				CompletedSteps: []pipelineStep{histogramsStep, exportsStep},
+				CompletedSteps: []pipelineStep{histogramsStep, exportsStep, maptilesStep},
 				Errors:         []string{},
 			},
 		},
@@ -173,7 +225,7 @@ func TestHandler_ServeHTTP(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := NewHandler(tt.bqClient, tt.exporter, tt.config)
+			h := NewHandler(tt.bqClient, tt.exporters, &mockMaptiles{}, tt.config)
 			recorder := httptest.NewRecorder()
 			h.ServeHTTP(recorder, tt.r)
 			statusCode := recorder.Result().StatusCode
@@ -192,6 +244,11 @@ func TestHandler_ServeHTTP(t *testing.T) {
 					t.Errorf("Error while unmarshalling response body")
 				}
 
+				// Run IDs are random: only check that runs have one.
+				if (responseJSON.RunID != "") != (tt.statusCode == http.StatusOK) {
+					t.Errorf("Invalid run ID: %q", responseJSON.RunID)
+				}
+				responseJSON.RunID = ""
 				if !reflect.DeepEqual(responseJSON, *tt.response) {
 					t.Errorf("Invalid response body: %v, expected %v", responseJSON,
 						tt.response)
@@ -202,15 +259,253 @@ func TestHandler_ServeHTTP(t *testing.T) {
 	}
 }
 
+// chargingHistogramTable charges the run's byte budget for each update.
+type chargingHistogramTable struct {
+	name    string
+	bytes   int64
+	mu      *sync.Mutex
+	updated *[]string
+}
+
+func (h *chargingHistogramTable) UpdateHistogram(ctx context.Context,
+	start, end time.Time) error {
+	h.mu.Lock()
+	*h.updated = append(*h.updated, h.name)
+	h.mu.Unlock()
+	return jobs.Charge(ctx, &bigquery.JobStatus{
+		Statistics: &bigquery.JobStatistics{TotalBytesProcessed: h.bytes},
+	})
+}
+
+func TestHandler_ServeHTTP_budget(t *testing.T) {
+	var mu sync.Mutex
+	var updated []string
+	newHistogramTable = func(name, ds string, config histogram.QueryConfig,
+		client bqiface.Client) HistogramTable {
+		return &chargingHistogramTable{name: name, bytes: 10, mu: &mu,
+			updated: &updated}
+	}
+	oldMax := *maxBytesPerRun
+	*maxBytesPerRun = 15
+	defer func() { *maxBytesPerRun = oldMax }()
+
+	// The configs depend on each other so that they are updated in order.
+	conf := map[string]config.Config{
+		"a": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "a",
+		},
+		"b": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "b",
+			DependsOn:          []string{"a"},
+		},
+		"c": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "c",
+			DependsOn:          []string{"b"},
+		},
+	}
+	h := NewHandler(&mockClient{}, nil, &mockMaptiles{}, conf)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+		"/v0/pipeline?start=2021-01-01&end=2021-01-02&step=all", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("ServeHTTP() returned status %d, want %d", rec.Code,
+			http.StatusInternalServerError)
+	}
+	if want := []string{"a_2021", "b_2021"}; !reflect.DeepEqual(updated, want) {
+		t.Errorf("ServeHTTP() updated %v, want %v", updated, want)
+	}
+	var result pipelineResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("cannot decode the result: %v", err)
+	}
+	if result.BytesProcessed != 20 {
+		t.Errorf("ServeHTTP() reported %d bytes processed, want 20",
+			result.BytesProcessed)
+	}
+	if len(result.CompletedSteps) != 0 {
+		t.Errorf("ServeHTTP() completed %v, want no steps",
+			result.CompletedSteps)
+	}
+	found := false
+	for _, e := range result.Errors {
+		if strings.Contains(e, "byte budget exceeded by config b") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ServeHTTP() returned errors %v, want a budget error for b",
+			result.Errors)
+	}
+}
+
+func TestHandler_updateHistograms(t *testing.T) {
+	// Record the order in which tables are updated and make the "failing"
+	// table fail.
+	var mu sync.Mutex
+	var updated []string
+	newHistogramTable = func(name, ds string, config histogram.QueryConfig,
+		client bqiface.Client) HistogramTable {
+		mu.Lock()
+		defer mu.Unlock()
+		updated = append(updated, name)
+		return &mockHistogramTable{mustFail: name == "failing_2021"}
+	}
+	conf := map[string]config.Config{
+		"continents": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "continents",
+		},
+		"global": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "global",
+			DependsOn:          []string{"continents"},
+		},
+		"failing": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "failing",
+		},
+		"failing_child": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "failing_child",
+			DependsOn:          []string{"failing"},
+		},
+		"failing_grandchild": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			Table:              "failing_grandchild",
+			DependsOn:          []string{"failing_child", "continents"},
+		},
+	}
+	failures := func(name string) float64 {
+		return testutil.ToFloat64(failuresTotal.WithLabelValues(name,
+			string(histogramsStep)))
+	}
+	oldFailures := map[string]float64{}
+	for name := range conf {
+		oldFailures[name] = failures(name)
+	}
+	h := NewHandler(&mockClient{}, nil, &mockMaptiles{}, conf)
+	start := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC)
+	errs := h.updateHistograms(context.Background(), start, end)
+
+	sort.Strings(errs)
+	wantErrs := []string{
+		"Cannot update histogram failing: cannot update histogram table failing_2021: UpdateHistogram() failed",
+		"Skipping histogram failing_child: failing failed",
+		"Skipping histogram failing_grandchild: failing_child failed",
+	}
+	if !reflect.DeepEqual(errs, wantErrs) {
+		t.Errorf("updateHistograms() = %v, want %v", errs, wantErrs)
+	}
+	// The dependents of the failing table must not be updated, and global
+	// must be updated after continents.
+	pos := map[string]int{}
+	for i, name := range updated {
+		pos[name] = i
+	}
+	if len(updated) != 3 {
+		t.Errorf("updateHistograms() updated %v", updated)
+	}
+	if pos["continents_2021"] > pos["global_2021"] {
+		t.Errorf("updateHistograms() updated global before continents: %v",
+			updated)
+	}
+	// Skipped configs count as failures too.
+	for name := range conf {
+		want := 0.0
+		if strings.HasPrefix(name, "failing") {
+			want = 1
+		}
+		if got := failures(name) - oldFailures[name]; got != want {
+			t.Errorf("updateHistograms() recorded %v failures for %s, want %v",
+				got, name, want)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_metrics(t *testing.T) {
+	newHistogramTable = func(name, ds string, config histogram.QueryConfig,
+		client bqiface.Client) HistogramTable {
+		return &mockHistogramTable{mustFail: name == "failing_2021"}
+	}
+	tests := []struct {
+		name   string
+		config config.Config
+		result string
+	}{
+		{
+			name: "success",
+			config: config.Config{
+				HistogramQueryFile: "testdata/test_histogram.sql",
+				Table:              "success",
+			},
+			result: "success",
+		},
+		{
+			name: "failure",
+			config: config.Config{
+				HistogramQueryFile: "testdata/test_histogram.sql",
+				Table:              "failing",
+			},
+			result: "failure",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := runsTotal.WithLabelValues("histograms", tt.result)
+			oldRuns := testutil.ToFloat64(runs)
+			lastSuccess := lastSuccessMetric.WithLabelValues("histograms")
+			lastSuccess.Set(0)
+
+			h := NewHandler(&mockClient{}, nil, &mockMaptiles{},
+				map[string]config.Config{tt.name: tt.config})
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+				http.MethodPost,
+				"/v0/pipeline?start=2021-01-01&end=2021-01-02&step=histograms",
+				nil))
+
+			if got := testutil.ToFloat64(runs) - oldRuns; got != 1 {
+				t.Errorf("ServeHTTP() recorded %v %s runs, want 1", got,
+					tt.result)
+			}
+			if success := testutil.ToFloat64(lastSuccess) != 0; success != (tt.result == "success") {
+				t.Errorf("ServeHTTP() set the last success time: %v, want %v",
+					success, tt.result == "success")
+			}
+			if got := testutil.ToFloat64(runningMetric); got != 0 {
+				t.Errorf("ServeHTTP() left the running metric at %v", got)
+			}
+		})
+	}
+}
+
+// TestPrometheusMetrics ensures that all the metrics pass the linter.
+func TestPrometheusMetrics(t *testing.T) {
+	runsTotal.WithLabelValues("x", "x")
+	runDurationHistogram.WithLabelValues("x")
+	lastSuccessMetric.WithLabelValues("x")
+	stepDurationHistogram.WithLabelValues("x")
+	histogramDurationHistogram.WithLabelValues("x")
+	failuresTotal.WithLabelValues("x", "x")
+
+	promtest.LintMetrics(t)
+}
+
 func TestNewHandler(t *testing.T) {
 	mc := &mockClient{}
-	me := &mockExporter{}
+	me := map[string]Exporter{"test": &mockExporter{}}
+	mm := &mockMaptiles{}
 	config := map[string]config.Config{}
-	h := NewHandler(mc, me, config)
+	h := NewHandler(mc, me, mm, config)
 	if h == nil {
 		t.Fatalf("NewHandler() returned nil")
 	}
-	if h.bqClient != mc || h.exporter != me || !reflect.DeepEqual(h.configs, config) {
+	if h.bqClient != mc || !reflect.DeepEqual(h.exporters, me) || h.maptiles != mm ||
+		!reflect.DeepEqual(h.configs, config) {
 		t.Errorf("NewHandler() didn't return the expected handler")
 	}
 	// Check we can read from the channel.
@@ -219,36 +514,42 @@ func TestNewHandler(t *testing.T) {
 	}
 }
 
-func Test_getYearlyRanges(t *testing.T) {
+func Test_getRanges(t *testing.T) {
 	tests := []struct {
-		name  string
-		start time.Time
-		end   time.Time
-		want  [][]time.Time
+		name        string
+		start       time.Time
+		end         time.Time
+		granularity string
+		want        []config.Period
+		wantErr     bool
 	}{
 		{
 			name:  "single-year",
 			start: time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
 			end:   time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
-			want: [][]time.Time{
+			want: []config.Period{
 				{
-					time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
 				},
 			},
 		},
 		{
-			name:  "two-adjacent-years",
-			start: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
-			end:   time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC),
-			want: [][]time.Time{
+			name:        "two-adjacent-years",
+			start:       time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+			end:         time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC),
+			granularity: config.Yearly,
+			want: []config.Period{
 				{
-					time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
 				},
 				{
-					time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC),
 				},
 			},
 		},
@@ -256,26 +557,249 @@ func Test_getYearlyRanges(t *testing.T) {
 			name:  "multiple-years",
 			start: time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
 			end:   time.Date(2022, time.August, 31, 0, 0, 0, 0, time.UTC),
-			want: [][]time.Time{
+			want: []config.Period{
+				{
+					Granularity: config.Yearly,
+					Start:       time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					Granularity: config.Yearly,
+					Start:       time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2022, time.August, 31, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:        "quarters",
+			start:       time.Date(2020, time.November, 15, 0, 0, 0, 0, time.UTC),
+			end:         time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC),
+			granularity: config.Quarterly,
+			want: []config.Period{
+				{
+					Granularity: config.Quarterly,
+					Start:       time.Date(2020, time.November, 15, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					Granularity: config.Quarterly,
+					Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.March, 31, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					Granularity: config.Quarterly,
+					Start:       time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:        "months",
+			start:       time.Date(2020, time.January, 31, 0, 0, 0, 0, time.UTC),
+			end:         time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+			granularity: config.Monthly,
+			want: []config.Period{
+				{
+					Granularity: config.Monthly,
+					Start:       time.Date(2020, time.January, 31, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2020, time.January, 31, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					Granularity: config.Monthly,
+					Start:       time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:        "invalid-granularity",
+			start:       time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+			end:         time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC),
+			granularity: "weekly",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getRanges(tt.start, tt.end, tt.granularity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getExportDates(t *testing.T) {
+	start := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		config    config.Config
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "no-bounds",
+			wantStart: start,
+			wantEnd:   end,
+		},
+		{
+			name: "clipped",
+			config: config.Config{
+				ExportStartDate: "2021-03-01",
+				ExportEndDate:   "2021-09-08",
+			},
+			wantStart: time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2021, time.September, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "bounds-outside-range",
+			config: config.Config{
+				ExportStartDate: "2019-03-29",
+				ExportEndDate:   "2022-01-01",
+			},
+			wantStart: start,
+			wantEnd:   end,
+		},
+		{
+			name: "no-overlap",
+			config: config.Config{
+				ExportEndDate: "2020-03-10",
+			},
+			wantStart: start,
+			wantEnd:   time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "invalid-start",
+			config: config.Config{
+				ExportStartDate: "xyz",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid-end",
+			config: config.Config{
+				ExportEndDate: "xyz",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStart, gotEnd, err := getExportDates(start, end, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getExportDates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !gotStart.Equal(tt.wantStart) || !gotEnd.Equal(tt.wantEnd) {
+				t.Errorf("getExportDates() = %v - %v, want %v - %v", gotStart,
+					gotEnd, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func Test_getConfigRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   time.Time
+		end     time.Time
+		config  config.Config
+		want    []config.Period
+		wantErr bool
+	}{
+		{
+			name:  "daily",
+			start: time.Date(2021, time.March, 3, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2021, time.March, 4, 0, 0, 0, 0, time.UTC),
+			want: []config.Period{
 				{
-					time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.March, 3, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.March, 4, 0, 0, 0, 0, time.UTC),
 				},
+			},
+		},
+		{
+			name:  "weekly-across-years",
+			start: time.Date(2020, time.December, 30, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2021, time.January, 5, 0, 0, 0, 0, time.UTC),
+			config: config.Config{
+				Granularity: config.Weekly,
+			},
+			want: []config.Period{
 				{
-					time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2020, time.December, 28, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC),
 				},
 				{
-					time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
-					time.Date(2022, time.August, 31, 0, 0, 0, 0, time.UTC),
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.January, 10, 0, 0, 0, 0, time.UTC),
 				},
 			},
 		},
+		{
+			name:  "monthly",
+			start: time.Date(2021, time.March, 30, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC),
+			config: config.Config{
+				Granularity: config.Monthly,
+			},
+			want: []config.Period{
+				{
+					Granularity: config.Yearly,
+					Start:       time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.April, 30, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:  "yearly-monthly-tables",
+			start: time.Date(2021, time.March, 30, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC),
+			config: config.Config{
+				Granularity: config.Yearly,
+				Period:      config.Monthly,
+			},
+			want: []config.Period{
+				{
+					Granularity: config.Monthly,
+					Start:       time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+					End:         time.Date(2021, time.December, 31, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:  "invalid-granularity",
+			start: time.Date(2021, time.March, 30, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2021, time.April, 2, 0, 0, 0, 0, time.UTC),
+			config: config.Config{
+				Granularity: "hourly",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getYearlyRanges(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("getYearlyRanges() = %v, want %v", got, tt.want)
+			got, err := getConfigRanges(tt.start, tt.end, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getConfigRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getConfigRanges() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// The step label of the run metrics is the requested step, i.e. "all" or
+	// the name of a single step.
+	runsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_runs_total",
+		Help: "Pipeline runs, by requested step and result",
+	}, []string{
+		"step", "result",
+	})
+
+	runDurationHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "stats_pipeline_run_duration_seconds",
+			Help: "Pipeline run duration histogram",
+			// From one minute to about 17 hours.
+			Buckets: prometheus.ExponentialBuckets(60, 2, 11),
+		},
+		[]string{"step"},
+	)
+
+	lastSuccessMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stats_pipeline_last_success_timestamp_seconds",
+		Help: "Time of the last pipeline run completed without errors",
+	}, []string{
+		"step",
+	})
+
+	runningMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stats_pipeline_running",
+		Help: "Whether a pipeline run is currently active",
+	})
+
+	stepDurationHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stats_pipeline_step_duration_seconds",
+			Help:    "Pipeline step duration histogram",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 11),
+		},
+		[]string{"step"},
+	)
+
+	histogramDurationHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "stats_pipeline_table_update_duration_seconds",
+			Help: "Histogram tables update duration histogram, by config",
+			// From 10 seconds to about 6 hours.
+			Buckets: prometheus.ExponentialBuckets(10, 2, 12),
+		},
+		[]string{"config"},
+	)
+
+	failuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stats_pipeline_failures_total",
+		Help: "Errors while running a pipeline step for a config",
+	}, []string{
+		"config", "step",
+	})
+)
@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses of a pipeline run.
+const (
+	runRunning   = "running"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+	runCancelled = "cancelled"
+)
+
+const (
+	// runsPath is the path the handler returned by Handler.Runs must be
+	// registered at, with and without a trailing slash.
+	runsPath = "/v0/pipeline/runs"
+
+	// maxFinishedRuns is the number of finished runs whose status is kept.
+	maxFinishedRuns = 20
+)
+
+// errRunCancelled is the cause of the cancellation of a run's context when the
+// run is cancelled through the runs endpoint.
+var errRunCancelled = errors.New("run cancelled")
+
+// runStatus is the status of a pipeline run, as returned by the runs endpoint.
+type runStatus struct {
+	ID             string
+	Step           string
+	Start          string
+	End            string
+	Incremental    bool
+	Status         string
+	StartTime      time.Time
+	EndTime        *time.Time `json:",omitempty"`
+	BytesProcessed int64
+	Errors         []string
+}
+
+// pipelineRun is a run of the pipeline, running or finished.
+type pipelineRun struct {
+	status runStatus
+	cancel context.CancelCauseFunc
+}
+
+// runs records the current and last pipeline runs.
+type runs struct {
+	mu   sync.Mutex
+	runs []*pipelineRun
+}
+
+// start records a new running run with the given status, and returns a
+// context that is canceled if the run is cancelled.
+func (rs *runs) start(ctx context.Context, status runStatus) (context.Context,
+	*pipelineRun) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	status.Status = runRunning
+	status.StartTime = time.Now().UTC()
+	run := &pipelineRun{status: status, cancel: cancel}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	// Forget the oldest finished runs.
+	finished := 0
+	for _, r := range rs.runs {
+		if r.status.Status != runRunning {
+			finished++
+		}
+	}
+	for i := 0; finished >= maxFinishedRuns && i < len(rs.runs); {
+		if rs.runs[i].status.Status == runRunning {
+			i++
+			continue
+		}
+		rs.runs = append(rs.runs[:i], rs.runs[i+1:]...)
+		finished--
+	}
+	rs.runs = append(rs.runs, run)
+	return ctx, run
+}
+
+// finish records the final status of a run, given the run's context and
+// result, and returns it.
+func (rs *runs) finish(ctx context.Context, run *pipelineRun,
+	result pipelineResult) string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	status := runSucceeded
+	switch {
+	case errors.Is(context.Cause(ctx), errRunCancelled):
+		status = runCancelled
+	case len(result.Errors) > 0:
+		status = runFailed
+	}
+	end := time.Now().UTC()
+	run.status.Status = status
+	run.status.EndTime = &end
+	run.status.BytesProcessed = result.BytesProcessed
+	run.status.Errors = result.Errors
+	run.cancel(nil)
+	return status
+}
+
+// get returns the status of the run with the given ID.
+func (rs *runs) get(id string) (runStatus, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, r := range rs.runs {
+		if r.status.ID == id {
+			return r.status, true
+		}
+	}
+	return runStatus{}, false
+}
+
+// list returns the status of every recorded run, from the oldest.
+func (rs *runs) list() []runStatus {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	statuses := make([]runStatus, 0, len(rs.runs))
+	for _, r := range rs.runs {
+		statuses = append(statuses, r.status)
+	}
+	return statuses
+}
+
+// cancel cancels the run with the given ID. It returns the run's status, and
+// whether the run has been found and was running.
+func (rs *runs) cancel(id string) (runStatus, bool, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, r := range rs.runs {
+		if r.status.ID != id {
+			continue
+		}
+		if r.status.Status != runRunning {
+			return r.status, true, false
+		}
+		r.cancel(errRunCancelled)
+		return r.status, true, true
+	}
+	return runStatus{}, false, false
+}
+
+// Runs returns the handler for the /v0/pipeline/runs endpoints:
+//   - GET /v0/pipeline/runs lists the current and last runs.
+//   - GET /v0/pipeline/runs/{id} returns the status of a run.
+//   - DELETE /v0/pipeline/runs/{id}, or POST /v0/pipeline/runs/{id}/cancel,
+//     cancels a running run. Its BigQuery jobs are canceled, and its status
+//     becomes "cancelled" once it has stopped.
+//
+// Run IDs are returned by /v0/pipeline in the RunID field of its result.
+func (h *Handler) Runs() http.Handler {
+	return http.HandlerFunc(h.serveRuns)
+}
+
+func (h *Handler) serveRuns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, runsPath), "/")
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.runs.list())
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		status, ok := h.runs.get(parts[0])
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown run: "+parts[0])
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case len(parts) == 1 && r.Method == http.MethodDelete,
+		len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+		status, found, cancelled := h.runs.cancel(parts[0])
+		switch {
+		case !found:
+			writeError(w, http.StatusNotFound, "unknown run: "+parts[0])
+		case !cancelled:
+			writeError(w, http.StatusConflict, "run is "+status.Status)
+		default:
+			slog.InfoContext(r.Context(), "cancelling run", "run_id", parts[0])
+			writeJSON(w, http.StatusAccepted, status)
+		}
+	case len(parts) <= 1 || len(parts) == 2 && parts[1] == "cancel":
+		writeError(w, http.StatusMethodNotAllowed,
+			http.StatusText(http.StatusMethodNotAllowed))
+	default:
+		writeError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, struct{ Errors []string }{Errors: []string{msg}})
+}
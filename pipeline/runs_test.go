@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingExporter exports until its context is canceled.
+type blockingExporter struct {
+	started chan struct{}
+}
+
+func (ex *blockingExporter) Export(ctx context.Context, c config.Config,
+	tpl *template.Template, p config.Period, incremental bool) error {
+	ex.started <- struct{}{}
+	<-ctx.Done()
+	return context.Cause(ctx)
+}
+
+func serveRuns(h *Handler, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.Runs().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestHandler_cancelRun(t *testing.T) {
+	conf := map[string]config.Config{
+		"test": {
+			HistogramQueryFile: "testdata/test_histogram.sql",
+			ExportQueryFile:    "testdata/test_export.sql",
+			Dataset:            "test",
+			Table:              "testtable",
+		},
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			path:   "/v0/pipeline/runs/%s",
+		},
+		{
+			name:   "post-cancel",
+			method: http.MethodPost,
+			path:   "/v0/pipeline/runs/%s/cancel",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := &blockingExporter{started: make(chan struct{})}
+			h := NewHandler(&mockClient{},
+				map[string]Exporter{"test": exporter}, &mockMaptiles{}, conf)
+			cancelled := runsTotal.WithLabelValues("exports", runCancelled)
+			oldCancelled := testutil.ToFloat64(cancelled)
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+					"/v0/pipeline?start=2021-01-01&end=2021-01-02&step=exports",
+					nil))
+				done <- rec
+			}()
+			<-exporter.started
+
+			// Find the running run.
+			var statuses []runStatus
+			rec := serveRuns(h, http.MethodGet, "/v0/pipeline/runs")
+			if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+				t.Fatalf("cannot decode the runs: %v", err)
+			}
+			if len(statuses) != 1 || statuses[0].Status != runRunning {
+				t.Fatalf("runs are %+v, want a running run", statuses)
+			}
+			id := statuses[0].ID
+
+			rec = serveRuns(h, tt.method, fmt.Sprintf(tt.path, id))
+			if rec.Code != http.StatusAccepted {
+				t.Errorf("cancelling returned status %d, want %d", rec.Code,
+					http.StatusAccepted)
+			}
+
+			rec = <-done
+			var result pipelineResult
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatalf("cannot decode the result: %v", err)
+			}
+			if result.RunID != id {
+				t.Errorf("ServeHTTP() returned run %q, want %q", result.RunID,
+					id)
+			}
+			if rec.Code != http.StatusInternalServerError ||
+				!strings.Contains(strings.Join(result.Errors, "\n"),
+					errRunCancelled.Error()) {
+				t.Errorf("ServeHTTP() returned %d %v, want a cancellation",
+					rec.Code, result.Errors)
+			}
+
+			// The run's final status is cancelled.
+			var status runStatus
+			rec = serveRuns(h, http.MethodGet, "/v0/pipeline/runs/"+id)
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatalf("cannot decode the run: %v", err)
+			}
+			if status.Status != runCancelled || status.EndTime == nil {
+				t.Errorf("run is %+v, want cancelled", status)
+			}
+			if got := testutil.ToFloat64(cancelled) - oldCancelled; got != 1 {
+				t.Errorf("ServeHTTP() recorded %v cancelled runs, want 1", got)
+			}
+
+			// A finished run can't be cancelled.
+			rec = serveRuns(h, tt.method, fmt.Sprintf(tt.path, id))
+			if rec.Code != http.StatusConflict {
+				t.Errorf("cancelling again returned status %d, want %d",
+					rec.Code, http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestHandler_Runs(t *testing.T) {
+	h := NewHandler(&mockClient{}, nil, &mockMaptiles{}, nil)
+	ctx, run := h.runs.start(context.Background(), runStatus{ID: "run"})
+	h.runs.finish(ctx, run, newPipelineResult())
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{
+			name:   "list",
+			method: http.MethodGet,
+			path:   "/v0/pipeline/runs",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "list-trailing-slash",
+			method: http.MethodGet,
+			path:   "/v0/pipeline/runs/",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "list-invalid-method",
+			method: http.MethodPost,
+			path:   "/v0/pipeline/runs",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "get",
+			method: http.MethodGet,
+			path:   "/v0/pipeline/runs/run",
+			want:   http.StatusOK,
+		},
+		{
+			name:   "get-unknown",
+			method: http.MethodGet,
+			path:   "/v0/pipeline/runs/unknown",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "delete-unknown",
+			method: http.MethodDelete,
+			path:   "/v0/pipeline/runs/unknown",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "delete-finished",
+			method: http.MethodDelete,
+			path:   "/v0/pipeline/runs/run",
+			want:   http.StatusConflict,
+		},
+		{
+			name:   "cancel-invalid-method",
+			method: http.MethodGet,
+			path:   "/v0/pipeline/runs/run/cancel",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "unknown-path",
+			method: http.MethodPost,
+			path:   "/v0/pipeline/runs/run/other",
+			want:   http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveRuns(h, tt.method, tt.path)
+			if rec.Code != tt.want {
+				t.Errorf("Runs() returned status %d, want %d", rec.Code,
+					tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Runs() returned Content-Type %q", ct)
+			}
+		})
+	}
+}
+
+func Test_runs_start(t *testing.T) {
+	rs := &runs{}
+	// The running run is kept regardless of its age.
+	_, running := rs.start(context.Background(), runStatus{ID: "running"})
+	for i := 0; i < maxFinishedRuns+5; i++ {
+		ctx, run := rs.start(context.Background(),
+			runStatus{ID: fmt.Sprint(i)})
+		rs.finish(ctx, run, newPipelineResult())
+	}
+	statuses := rs.list()
+	if len(statuses) != maxFinishedRuns+1 {
+		t.Fatalf("list() returned %d runs, want %d", len(statuses),
+			maxFinishedRuns+1)
+	}
+	if statuses[0].ID != running.status.ID || statuses[1].ID != "5" {
+		t.Errorf("list() returned %s, %s..., want running, 5...",
+			statuses[0].ID, statuses[1].ID)
+	}
+}
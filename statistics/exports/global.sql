@@ -0,0 +1,4 @@
+SELECT *, EXTRACT(YEAR from date) as year
+FROM {{ .sourceTable }}
+WHERE shard = {{ .partitionID }}
+ORDER BY date, bucket_min
@@ -0,0 +1,50 @@
+--Summarize a year of daily histograms per GEOID and half of the year, in the
+--format expected by the maptiles join (see maptiles/Makefile).
+WITH
+--Collapse the histogram buckets into one row per day
+daily AS (
+  SELECT
+    GEOID,
+    date,
+    IF(EXTRACT(MONTH FROM date) <= 6, 'jan_jun', 'july_dec') AS half,
+    ANY_VALUE(download_MED) AS download_MED,
+    ANY_VALUE(upload_MED) AS upload_MED,
+    SUM(dl_samples_bucket) AS dl_samples,
+    SUM(ul_samples_bucket) AS ul_samples,
+    SUM(IF(bucket_min > 2.5, dl_samples_bucket, 0)) AS dl_samples_over_audio,
+    SUM(IF(bucket_min > 10, dl_samples_bucket, 0)) AS dl_samples_over_video
+  FROM `{{ .sourceTable }}`
+  GROUP BY GEOID, date
+),
+--Aggregate the daily rows per half of the year
+halves AS (
+  SELECT
+    GEOID,
+    half,
+    APPROX_QUANTILES(download_MED, 100) [SAFE_ORDINAL(50)] AS median_dl,
+    APPROX_QUANTILES(upload_MED, 100) [SAFE_ORDINAL(50)] AS median_ul,
+    SUM(dl_samples) AS total_dl_samples,
+    SUM(ul_samples) AS total_ul_samples,
+    SAFE_DIVIDE(SUM(dl_samples_over_audio), SUM(dl_samples)) AS percent_over_audio_threshold,
+    SAFE_DIVIDE(SUM(dl_samples_over_video), SUM(dl_samples)) AS percent_over_video_threshold
+  FROM daily
+  GROUP BY GEOID, half
+)
+--Pivot the halves into columns prefixed by the year
+SELECT
+  GEOID AS geo_id,
+  MAX(IF(half = 'jan_jun', median_dl, NULL)) AS `{{ .year }}_jan_jun_median_dl`,
+  MAX(IF(half = 'july_dec', median_dl, NULL)) AS `{{ .year }}_july_dec_median_dl`,
+  MAX(IF(half = 'jan_jun', median_ul, NULL)) AS `{{ .year }}_jan_jun_median_ul`,
+  MAX(IF(half = 'july_dec', median_ul, NULL)) AS `{{ .year }}_july_dec_median_ul`,
+  MAX(IF(half = 'jan_jun', total_dl_samples, NULL)) AS `{{ .year }}_jan_jun_total_dl_samples`,
+  MAX(IF(half = 'july_dec', total_dl_samples, NULL)) AS `{{ .year }}_july_dec_total_dl_samples`,
+  MAX(IF(half = 'jan_jun', total_ul_samples, NULL)) AS `{{ .year }}_jan_jun_total_ul_samples`,
+  MAX(IF(half = 'july_dec', total_ul_samples, NULL)) AS `{{ .year }}_july_dec_total_ul_samples`,
+  MAX(IF(half = 'jan_jun', percent_over_audio_threshold, NULL)) AS `{{ .year }}_jan_jun_percent_over_audio_threshold`,
+  MAX(IF(half = 'july_dec', percent_over_audio_threshold, NULL)) AS `{{ .year }}_july_dec_percent_over_audio_threshold`,
+  MAX(IF(half = 'jan_jun', percent_over_video_threshold, NULL)) AS `{{ .year }}_jan_jun_percent_over_video_threshold`,
+  MAX(IF(half = 'july_dec', percent_over_video_threshold, NULL)) AS `{{ .year }}_july_dec_percent_over_video_threshold`
+FROM halves
+GROUP BY GEOID
+ORDER BY GEOID
@@ -40,10 +40,11 @@ dl_fingerprinted AS (
 ),
 --Select two random rows for each IP using a prime number larger than the 
 --  total number of tests. random1 is used for per day/geo statistics in 
---  `dl_stats_per_day` and log averages using both random1 and random2
+--  `dl_stats_per_day` and log averages using both random1 and random2.
+--  For rollups, the date is truncated to the start of the week, month or year.
 dl_random_ip_rows_perday AS (
   SELECT
-    date,
+    {{ .rollupDate }} AS date,
     continent_code,
     asn,
     ip,
@@ -128,10 +129,11 @@ ul_fingerprinted AS (
 ),
 --Select two random rows for each IP using a prime number larger than the 
 --  total number of tests. random1 is used for per day/geo statistics in 
---  `ul_stats_per_day` and log averages using both random1 and random2
+--  `ul_stats_per_day` and log averages using both random1 and random2.
+--  For rollups, the date is truncated to the start of the week, month or year.
 ul_random_ip_rows_perday AS (
   SELECT
-    date,
+    {{ .rollupDate }} AS date,
     continent_code,
     asn,
     ip,
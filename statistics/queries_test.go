@@ -0,0 +1,597 @@
+// Package statistics contains the histogram and export queries used by the
+// stats pipeline. This test file checks the queries referenced by the default
+// configuration against golden files.
+package statistics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"unicode"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/exporter"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// Sample parameters used to render the histogram queries.
+var histogramParams = strings.NewReplacer(
+	"@startdate", "'2021-01-01'",
+	"@enddate", "'2021-12-31'",
+)
+
+// Sample parameters used to render the export queries.
+var exportParams = map[string]string{
+	"sourceTable": "mlab-sandbox.statistics.table_2021",
+	"partitionID": "1",
+	"project":     "mlab-sandbox",
+	"period":      "2021",
+	"periodStart": "2021-01-01",
+	"periodEnd":   "2021-12-31",
+}
+
+// Columns every histogram table must have: the date and bucket of each row,
+// and the shard used to partition the table and the export queries.
+var histogramColumns = []string{"date", "bucket_min", "bucket_max", "shard"}
+
+// renderHistogramQuery renders a histogram query template for daily rows and
+// replaces its query parameters with sample values.
+func renderHistogramQuery(t *testing.T, content string) string {
+	tpl, err := template.New("query").Option("missingkey=error").Parse(content)
+	if err != nil {
+		t.Fatalf("cannot parse histogram query: %v", err)
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, map[string]string{
+		"rollupDate": "date",
+	})
+	if err != nil {
+		t.Fatalf("cannot render histogram query: %v", err)
+	}
+	return histogramParams.Replace(buf.String())
+}
+
+// loadConfig reads the default configuration file at the repository's root.
+func loadConfig(t *testing.T) map[string]config.Config {
+	content, err := os.ReadFile("../config.json")
+	rtx.Must(err, "cannot read config.json")
+	var configs map[string]config.Config
+	rtx.Must(json.Unmarshal(content, &configs), "cannot parse config.json")
+	return configs
+}
+
+// checkGolden compares got with the content of testdata/name, or updates
+// testdata/name if the -update flag is set.
+func checkGolden(t *testing.T, name, got string) {
+	golden := filepath.Join("testdata", name)
+	if *update {
+		rtx.Must(os.MkdirAll(filepath.Dir(golden), 0775),
+			"cannot create golden directory")
+		rtx.Must(os.WriteFile(golden, []byte(got), 0664),
+			"cannot write golden file")
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("cannot read golden file %s: %v", golden, err)
+	}
+	if got != string(want) {
+		t.Errorf("query does not match %s, run go test with -update and "+
+			"review the diff", golden)
+	}
+}
+
+// renderExportQuery renders an export query template with sample parameters.
+func renderExportQuery(t *testing.T, content string) string {
+	tpl, err := template.New("query").Option("missingkey=error").Parse(content)
+	if err != nil {
+		t.Fatalf("cannot parse export query: %v", err)
+	}
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, exportParams); err != nil {
+		t.Fatalf("cannot render export query: %v", err)
+	}
+	return buf.String()
+}
+
+// goldenName returns the name of the golden file for a query file.
+func goldenName(dir, queryFile string) string {
+	base := strings.TrimSuffix(filepath.Base(queryFile), ".sql")
+	return filepath.Join(dir, base+".golden.sql")
+}
+
+// lexSQL splits a BigQuery query into tokens, skipping comments and string
+// literals. Quoted identifiers are returned without their backticks. It
+// returns an error for unterminated comments, strings and quoted identifiers,
+// and for unbalanced parentheses or brackets.
+func lexSQL(query string) ([]string, error) {
+	var tokens []string
+	var open []byte
+	closing := map[byte]byte{')': '(', ']': '['}
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' ||
+			c >= 'A' && c <= 'Z'
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return tokens, nil
+			}
+			i += end + 1
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			quote := string(c)
+			if strings.HasPrefix(query[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			j := i + len(quote)
+			for ; j < len(query) && !strings.HasPrefix(query[j:], quote); j++ {
+				if query[j] == '\\' {
+					j++
+				} else if query[j] == '\n' && len(quote) == 1 {
+					break
+				}
+			}
+			if j >= len(query) || !strings.HasPrefix(query[j:], quote) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			i = j + len(quote)
+		case c == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at offset %d", i)
+			}
+			tokens = append(tokens, query[i+1:i+1+end])
+			i += end + 2
+		case isWord(c):
+			j := i
+			for j < len(query) && isWord(query[j]) {
+				j++
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		default:
+			switch c {
+			case '(', '[':
+				open = append(open, c)
+			case ')', ']':
+				if len(open) == 0 || open[len(open)-1] != closing[c] {
+					return nil, fmt.Errorf("unbalanced %q at offset %d", c, i)
+				}
+				open = open[:len(open)-1]
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	if len(open) > 0 {
+		return nil, fmt.Errorf("unclosed %q", open[len(open)-1])
+	}
+	return tokens, nil
+}
+
+// checkSQL checks that query is lexically valid and starts with WITH or
+// SELECT. It returns the lowercase names of the query's output columns, as
+// returned by outputColumns.
+func checkSQL(t *testing.T, name, query string) map[string]bool {
+	tokens, err := lexSQL(query)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return nil
+	}
+	if len(tokens) == 0 {
+		t.Errorf("%s: empty query", name)
+		return nil
+	}
+	if first := strings.ToUpper(tokens[0]); first != "WITH" && first != "SELECT" {
+		t.Errorf("%s: query starts with %s, want WITH or SELECT", name,
+			tokens[0])
+	}
+	return outputColumns(tokens, nil)
+}
+
+// clauseEnd are the keywords ending the FROM clause of a SELECT.
+var clauseEnd = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "QUALIFY": true,
+	"WINDOW": true, "ORDER": true, "LIMIT": true, "UNION": true,
+	"EXCEPT": true, "INTERSECT": true,
+}
+
+// endsClause reports whether tokens[i] ends a clause of a SELECT. EXCEPT only
+// does so as a set operation, not in SELECT * EXCEPT (...).
+func endsClause(tokens []string, i int) bool {
+	if strings.EqualFold(tokens[i], "EXCEPT") {
+		return i+1 >= len(tokens) || tokens[i+1] != "("
+	}
+	return clauseEnd[strings.ToUpper(tokens[i])]
+}
+
+// joinKeywords are the keywords that can follow a table in a FROM clause,
+// and therefore are not table aliases.
+var joinKeywords = map[string]bool{
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true,
+	"OUTER": true, "CROSS": true, "USING": true, "ON": true,
+}
+
+// matching returns the index of the token closing the parenthesis or bracket
+// at tokens[i]. The tokens must come from lexSQL, so they are balanced.
+func matching(tokens []string, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j] {
+		case "(", "[":
+			depth++
+		case ")", "]":
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+// isIdent reports whether token is an identifier or a keyword.
+func isIdent(token string) bool {
+	return token != "" && (token[0] == '_' || unicode.IsLetter(rune(token[0])))
+}
+
+// outputColumns returns the lowercase names of the columns returned by the
+// outermost SELECT of a query, given the query's tokens and the CTEs defined
+// by its enclosing queries. Columns selected with * or alias.* are resolved
+// through the query's CTEs and subqueries; those of other tables are unknown
+// and are not returned. For set operations, only the first SELECT is used,
+// since it names the columns.
+func outputColumns(tokens []string, ctes map[string][]string) map[string]bool {
+	i := 0
+	if len(tokens) > 0 && strings.EqualFold(tokens[0], "WITH") {
+		scoped := map[string][]string{}
+		for name, body := range ctes {
+			scoped[name] = body
+		}
+		ctes = scoped
+		for i = 1; i+2 < len(tokens) && strings.EqualFold(tokens[i+1], "AS") &&
+			tokens[i+2] == "("; {
+			end := matching(tokens, i+2)
+			ctes[strings.ToLower(tokens[i])] = tokens[i+3 : end]
+			i = end + 1
+			if i >= len(tokens) || tokens[i] != "," {
+				break
+			}
+			i++
+		}
+	}
+	// Find the outermost SELECT, e.g. after the CTEs or parentheses.
+	for i < len(tokens) && !strings.EqualFold(tokens[i], "SELECT") {
+		i++
+	}
+	i++
+	for i < len(tokens) && (strings.EqualFold(tokens[i], "DISTINCT") ||
+		strings.EqualFold(tokens[i], "ALL")) {
+		i++
+	}
+	// Split the select list into items, up to its FROM.
+	var items [][]string
+	start := i
+	for ; i <= len(tokens); i++ {
+		if i == len(tokens) || tokens[i] == "," ||
+			strings.EqualFold(tokens[i], "FROM") || endsClause(tokens, i) {
+			if i > start {
+				items = append(items, tokens[start:i])
+			}
+			if i == len(tokens) || tokens[i] != "," {
+				break
+			}
+			start = i + 1
+		} else if tokens[i] == "(" || tokens[i] == "[" {
+			i = matching(tokens, i)
+		}
+	}
+	sources := fromSources(tokens[i:], ctes)
+	columns := map[string]bool{}
+	for _, item := range items {
+		n := len(item)
+		switch {
+		case item[0] == "*" || n >= 3 && item[1] == "." && item[2] == "*":
+			star := map[string]bool{}
+			if item[0] == "*" {
+				for _, cols := range sources {
+					for c := range cols {
+						star[c] = true
+					}
+				}
+			} else {
+				for c := range sources[strings.ToLower(item[0])] {
+					star[c] = true
+				}
+			}
+			// Remove the columns listed in * EXCEPT (...).
+			for j := 1; j+1 < n; j++ {
+				if strings.EqualFold(item[j], "EXCEPT") && item[j+1] == "(" {
+					for _, c := range item[j+2 : matching(item, j+1)] {
+						delete(star, strings.ToLower(c))
+					}
+				}
+			}
+			for c := range star {
+				columns[c] = true
+			}
+		case n >= 2 && strings.EqualFold(item[n-2], "AS"):
+			columns[strings.ToLower(item[n-1])] = true
+		case isIdent(item[n-1]):
+			// A column, a.b.column, or an expression with an implicit alias.
+			columns[strings.ToLower(item[n-1])] = true
+		}
+	}
+	return columns
+}
+
+// fromSources returns the output columns of the CTEs and subqueries read by a
+// FROM clause, indexed by their lowercase names and aliases. Other tables have
+// no known columns.
+func fromSources(tokens []string, ctes map[string][]string) map[string]map[string]bool {
+	sources := map[string]map[string]bool{}
+	if len(tokens) == 0 || !strings.EqualFold(tokens[0], "FROM") {
+		return sources
+	}
+	for i := 1; i < len(tokens) && !endsClause(tokens, i); {
+		var name string
+		var columns map[string]bool
+		switch {
+		case tokens[i] == "(":
+			end := matching(tokens, i)
+			columns = outputColumns(tokens[i+1:end], ctes)
+			i = end + 1
+		case strings.EqualFold(tokens[i], "UNNEST"):
+			i = matching(tokens, i+1) + 1
+		default:
+			name = strings.ToLower(tokens[i])
+			if body, ok := ctes[name]; ok {
+				columns = outputColumns(body, ctes)
+			}
+			// Skip the rest of unquoted table names, e.g. project.dataset.table.
+			for i++; i+1 < len(tokens) && (tokens[i] == "." || tokens[i] == "-"); i += 2 {
+			}
+		}
+		if i < len(tokens) && strings.EqualFold(tokens[i], "AS") {
+			i++
+		}
+		if i < len(tokens) && isIdent(tokens[i]) &&
+			!joinKeywords[strings.ToUpper(tokens[i])] &&
+			!endsClause(tokens, i) {
+			name = strings.ToLower(tokens[i])
+			i++
+		}
+		if name == "" {
+			// Unnamed subqueries can only be selected with *.
+			name = fmt.Sprintf("(%d)", len(sources))
+		}
+		sources[name] = columns
+		// Skip the join condition, up to the next table.
+		for ; i < len(tokens) && !endsClause(tokens, i); i++ {
+			if tokens[i] == "(" || tokens[i] == "[" {
+				i = matching(tokens, i)
+			} else if tokens[i] == "," || strings.EqualFold(tokens[i], "JOIN") {
+				i++
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// queryFiles returns the histogram and export query files referenced by the
+// configs, each with the sorted names of the configs referencing it.
+func queryFiles(configs map[string]config.Config) (map[string][]string,
+	map[string][]string) {
+	histograms := map[string][]string{}
+	exports := map[string][]string{}
+	for name, c := range configs {
+		histograms[c.HistogramQueryFile] = append(
+			histograms[c.HistogramQueryFile], name)
+		exports[c.ExportQueryFile] = append(exports[c.ExportQueryFile], name)
+	}
+	for _, m := range []map[string][]string{histograms, exports} {
+		for _, names := range m {
+			sort.Strings(names)
+		}
+	}
+	return histograms, exports
+}
+
+func TestLexSQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "comments-and-strings",
+			query: "SELECT a AS `b`, 'it\\'s (' -- )\n" +
+				"# )\n/* ( */ FROM t WHERE x[OFFSET(0)] = \"\"\"a)\nb\"\"\"",
+			want: []string{"SELECT", "a", "AS", "b", ",", "FROM", "t",
+				"WHERE", "x", "[", "OFFSET", "(", "0", ")", "]", "="},
+		},
+		{
+			name:    "unbalanced",
+			query:   "SELECT (a FROM t",
+			wantErr: true,
+		},
+		{
+			name:    "mismatched",
+			query:   "SELECT a[0) FROM t",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated-string",
+			query:   "SELECT 'a\nFROM t",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated-comment",
+			query:   "SELECT a /* FROM t",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lexSQL(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lexSQL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("lexSQL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputColumns(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "select-list",
+			query: "SELECT a, t.b, c AS d, COUNT(*) AS n, f(x) y, FROM t",
+			want:  []string{"a", "b", "d", "n", "y"},
+		},
+		{
+			name:  "cte-star",
+			query: "WITH x AS (SELECT a, MOD(b, 10) AS shard FROM t) SELECT * FROM x",
+			want:  []string{"a", "shard"},
+		},
+		{
+			name:  "column-dropped-by-final-select",
+			query: "WITH x AS (SELECT a, 0 AS shard FROM t) SELECT a FROM x",
+			want:  []string{"a"},
+		},
+		{
+			name: "join-star-except",
+			query: "WITH x AS (SELECT a, b FROM t), y AS (SELECT a, c FROM u) " +
+				"SELECT * EXCEPT (b), y.* FROM x JOIN y USING (a) WHERE a > 0",
+			want: []string{"a", "c"},
+		},
+		{
+			name:  "subquery",
+			query: "SELECT * FROM (SELECT a, b AS c FROM t) WHERE a > 0",
+			want:  []string{"a", "c"},
+		},
+		{
+			name:  "union",
+			query: "SELECT a FROM t UNION ALL SELECT b FROM u",
+			want:  []string{"a"},
+		},
+		{
+			name:  "unknown-table",
+			query: "SELECT *, EXTRACT(YEAR FROM date) AS year FROM mlab-sandbox.d.t",
+			want:  []string{"year"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexSQL(tt.query)
+			if err != nil {
+				t.Fatalf("lexSQL() error = %v", err)
+			}
+			var got []string
+			for c := range outputColumns(tokens, nil) {
+				got = append(got, c)
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("outputColumns() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramQueries(t *testing.T) {
+	configs := loadConfig(t)
+	histograms, _ := queryFiles(configs)
+	for file, names := range histograms {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("..", file))
+			if err != nil {
+				t.Fatalf("cannot read %s: %v", file, err)
+			}
+			query := renderHistogramQuery(t, string(content))
+			aliases := checkSQL(t, file, query)
+			if aliases == nil {
+				return
+			}
+			for _, col := range histogramColumns {
+				if !aliases[strings.ToLower(col)] {
+					t.Errorf("%s: no %s column", file, col)
+				}
+			}
+			// Every field used in the output paths must be a column of the
+			// histogram table, or be computed by the export query.
+			for _, name := range names {
+				c := configs[name]
+				export, err := os.ReadFile(filepath.Join("..", c.ExportQueryFile))
+				if err != nil {
+					t.Fatalf("cannot read %s: %v", c.ExportQueryFile, err)
+				}
+				exportAliases := checkSQL(t, c.ExportQueryFile,
+					renderExportQuery(t, string(export)))
+				fields, err := exporter.OutputPathFields(c.OutputPath)
+				if err != nil {
+					t.Errorf("%s: invalid output path: %v", name, err)
+				}
+				for _, f := range fields {
+					field := strings.ToLower(f)
+					if !aliases[field] && !exportAliases[field] {
+						t.Errorf("%s: no %s column for the output path of %s",
+							file, f, name)
+					}
+				}
+			}
+			checkGolden(t, goldenName("queries", file), query)
+		})
+	}
+}
+
+func TestExportQueries(t *testing.T) {
+	_, exports := queryFiles(loadConfig(t))
+	for file := range exports {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join("..", file))
+			if err != nil {
+				t.Fatalf("cannot read %s: %v", file, err)
+			}
+			// Export queries must read a single partition of the source
+			// table, as listed by the formatter.
+			for _, param := range []string{"sourceTable", "partitionID"} {
+				if !regexp.MustCompile(`{{\s*\.` + param + `\s*}}`).Match(content) {
+					t.Errorf("%s does not use {{ .%s }}", file, param)
+				}
+			}
+			query := renderExportQuery(t, string(content))
+			checkSQL(t, file, query)
+			checkGolden(t, goldenName("exports", file), query)
+		})
+	}
+}
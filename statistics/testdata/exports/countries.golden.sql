@@ -0,0 +1,4 @@
+SELECT *, EXTRACT(YEAR from date) as year
+FROM mlab-sandbox.statistics.table_2021
+WHERE shard = 1
+ORDER BY continent_code, country_code, date, bucket_min
@@ -0,0 +1,127 @@
+// Package tiles generates per-year aggregates of the histogram tables, used to
+// build the map tiles.
+package tiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"text/template"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/stats-pipeline/config"
+	"github.com/m-lab/stats-pipeline/exporter"
+	"github.com/m-lab/stats-pipeline/jobs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	bytesProcessedMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stats_pipeline_maptiles_bytes_processed",
+		Help: "Bytes processed by the maptiles queries",
+	}, []string{
+		"table",
+	})
+)
+
+// Generator runs the maptiles queries and writes their results as a single
+// JSON array per year.
+type Generator struct {
+	bqClient  bqiface.Client
+	projectID string
+	output    exporter.Writer
+}
+
+// New creates a new Generator.
+func New(bqClient bqiface.Client, projectID string,
+	output exporter.Writer) *Generator {
+	return &Generator{
+		bqClient:  bqClient,
+		projectID: projectID,
+		output:    output,
+	}
+}
+
+// Generate runs the provided query template over all the histogram tables
+// for the period's year and uploads the resulting rows, as a JSON array, to
+// config.MaptilesOutputPath.
+//
+// The query template's parameters are:
+// - sourceTable: a wildcard table matching every histogram table of the year,
+// regardless of config.Period (e.g. project.dataset.table_2020*).
+// - year: the year being generated.
+//
+// config.MaptilesOutputPath is a template whose only parameter is the year.
+func (g *Generator) Generate(ctx context.Context, config config.Config,
+	queryTpl *template.Template, period config.Period) error {
+	outputPath, err := template.New("outputPath").Parse(config.MaptilesOutputPath)
+	if err != nil {
+		return err
+	}
+	params := map[string]interface{}{
+		"sourceTable": fmt.Sprintf("%s.%s.%s_%d*", g.projectID,
+			config.Dataset, config.Table, period.Year()),
+		"year": period.Year(),
+	}
+	var query, path bytes.Buffer
+	if err = queryTpl.Execute(&query, params); err != nil {
+		return err
+	}
+	if err = outputPath.Execute(&path, params); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "running maptiles query", "table", config.Table,
+		"year", period.Year())
+	q := g.bqClient.Query(query.String())
+	qc := bqiface.QueryConfig{}
+	qc.Q = query.String()
+	jobs.Configure(ctx, q, qc, jobs.IDPrefix("maptiles",
+		fmt.Sprintf("%s_%d", config.Table, period.Year()), query.String()))
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := jobs.Wait(ctx, job)
+	if err != nil {
+		return err
+	}
+	if status.Err() != nil {
+		return status.Err()
+	}
+	if err := jobs.Charge(ctx, status); err != nil {
+		return err
+	}
+	if details, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		bytesProcessedMetric.WithLabelValues(config.Table).Add(
+			float64(details.TotalBytesProcessed))
+	}
+	it, err := job.Read(ctx)
+	if err != nil {
+		return err
+	}
+	rows := []map[string]bigquery.Value{}
+	for {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+	content, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "writing maptiles", "rows", len(rows),
+		"path", path.String())
+	return g.output.Write(ctx, path.String(), content)
+}
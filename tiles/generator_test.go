@@ -0,0 +1,185 @@
+package tiles
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/m-lab/stats-pipeline/config"
+	"google.golang.org/api/iterator"
+)
+
+// ***** mockClient *****
+type mockClient struct {
+	bqiface.Client
+	runMustFail bool
+	queries     []string
+	rows        []map[string]bigquery.Value
+}
+
+func (c *mockClient) Query(query string) bqiface.Query {
+	return &mockQuery{
+		client: c,
+		q:      query,
+	}
+}
+
+// ***** mockQuery *****
+type mockQuery struct {
+	bqiface.Query
+	client      *mockClient
+	q           string
+	qc          bqiface.QueryConfig
+	jobIDConfig bigquery.JobIDConfig
+}
+
+func (q *mockQuery) SetQueryConfig(qc bqiface.QueryConfig) {
+	q.qc = qc
+}
+
+func (q *mockQuery) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobIDConfig
+}
+
+func (q *mockQuery) Run(context.Context) (bqiface.Job, error) {
+	if q.client.runMustFail {
+		return nil, errors.New("Run() failed")
+	}
+	q.client.queries = append(q.client.queries, q.q)
+	return &mockJob{rows: q.client.rows}, nil
+}
+
+// ***** mockJob *****
+type mockJob struct {
+	bqiface.Job
+	rows []map[string]bigquery.Value
+}
+
+func (j *mockJob) Wait(context.Context) (*bigquery.JobStatus, error) {
+	return &bigquery.JobStatus{
+		State: bigquery.Done,
+		Statistics: &bigquery.JobStatistics{
+			Details: &bigquery.QueryStatistics{
+				TotalBytesProcessed: 10,
+			},
+		},
+	}, nil
+}
+
+func (j *mockJob) Read(context.Context) (bqiface.RowIterator, error) {
+	return &mockRowIterator{rows: j.rows}, nil
+}
+
+// ***** mockRowIterator *****
+type mockRowIterator struct {
+	bqiface.RowIterator
+	rows  []map[string]bigquery.Value
+	index int
+}
+
+func (it *mockRowIterator) Next(dst interface{}) error {
+	if it.index >= len(it.rows) {
+		return iterator.Done
+	}
+	v := dst.(*map[string]bigquery.Value)
+	*v = it.rows[it.index]
+	it.index++
+	return nil
+}
+
+// ***** mockWriter *****
+type mockWriter struct {
+	path    string
+	content []byte
+}
+
+func (w *mockWriter) Write(ctx context.Context, path string, content []byte) error {
+	w.path = path
+	w.content = content
+	return nil
+}
+
+func TestGenerator_Generate(t *testing.T) {
+	period := config.Period{
+		Granularity: config.Yearly,
+		Start:       time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+		End:         time.Date(2020, time.March, 2, 0, 0, 0, 0, time.UTC),
+	}
+	conf := config.Config{
+		Dataset:            "statistics",
+		Table:              "us_counties",
+		MaptilesOutputPath: "maptiles/{{ .year }}/mlab-counties.json",
+	}
+	tpl := template.Must(template.New("query").Parse(
+		"SELECT {{ .year }} FROM `{{ .sourceTable }}`"))
+	tests := []struct {
+		name        string
+		client      *mockClient
+		wantQuery   string
+		wantPath    string
+		wantContent string
+		wantErr     bool
+	}{
+		{
+			name: "success",
+			client: &mockClient{
+				rows: []map[string]bigquery.Value{
+					{"geo_id": "24031"},
+					{"geo_id": "24033"},
+				},
+			},
+			wantQuery:   "SELECT 2020 FROM `project.statistics.us_counties_2020*`",
+			wantPath:    "maptiles/2020/mlab-counties.json",
+			wantContent: `[{"geo_id":"24031"},{"geo_id":"24033"}]`,
+		},
+		{
+			name:        "success-no-rows",
+			client:      &mockClient{},
+			wantQuery:   "SELECT 2020 FROM `project.statistics.us_counties_2020*`",
+			wantPath:    "maptiles/2020/mlab-counties.json",
+			wantContent: `[]`,
+		},
+		{
+			name: "failure-run",
+			client: &mockClient{
+				runMustFail: true,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr := &mockWriter{}
+			g := New(tt.client, "project", wr)
+			err := g.Generate(context.Background(), conf, tpl, period)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Generate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(tt.client.queries) != 1 || tt.client.queries[0] != tt.wantQuery {
+				t.Errorf("Generate() ran %v, want %v", tt.client.queries, tt.wantQuery)
+			}
+			if wr.path != tt.wantPath {
+				t.Errorf("Generate() wrote to %v, want %v", wr.path, tt.wantPath)
+			}
+			if string(wr.content) != tt.wantContent {
+				t.Errorf("Generate() wrote %v, want %v", string(wr.content),
+					tt.wantContent)
+			}
+		})
+	}
+}
+
+// TestPrometheusMetrics ensures that all the metrics pass the linter.
+func TestPrometheusMetrics(t *testing.T) {
+	bytesProcessedMetric.WithLabelValues("x")
+
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,121 @@
+// Package tracing configures the OpenTelemetry spans emitted by the stats
+// pipeline, and provides helpers to annotate them.
+//
+// Spans are exported with -tracing.exporter. The OTLP exporter sends them over
+// HTTP and is configured with the standard OTEL_EXPORTER_OTLP_* environment
+// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/flagx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// None disables tracing.
+	None = "none"
+	// OTLP exports spans to an OTLP collector over HTTP.
+	OTLP = "otlp"
+	// Stdout prints spans to stdout, for local runs.
+	Stdout = "stdout"
+)
+
+var exporterType = flagx.Enum{
+	Options: []string{None, OTLP, Stdout},
+	Value:   None,
+}
+
+func init() {
+	flag.Var(&exporterType, "tracing.exporter",
+		"Where to export the trace spans (none, otlp or stdout)")
+}
+
+// Setup installs the global TracerProvider for the exporter selected with
+// -tracing.exporter. The returned function flushes the pending spans and must
+// be called before exiting.
+func Setup(ctx context.Context, service string) (func(context.Context) error,
+	error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporterType.Value {
+	case None:
+		return func(context.Context) error { return nil }, nil
+	case OTLP:
+		exp, err = otlptracehttp.New(ctx)
+	case Stdout:
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		err = fmt.Errorf("invalid tracing exporter: %q", exporterType.Value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// SetError marks the span as failed if err is not nil.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// QueryAttributes returns the span attributes identifying a query: the name
+// of the config it belongs to and a hash of its text. The query itself isn't
+// recorded, since it can exceed the exporters' size limits.
+func QueryAttributes(config, query string) []attribute.KeyValue {
+	h := sha256.Sum256([]byte(query))
+	return []attribute.KeyValue{
+		attribute.String("config", config),
+		attribute.String("query.sha256", hex.EncodeToString(h[:])),
+	}
+}
+
+// SetJob adds the ID and the statistics of a BigQuery job to the span. The
+// status may be nil if the job has not completed.
+func SetJob(span trace.Span, job bqiface.Job, status *bigquery.JobStatus) {
+	span.SetAttributes(attribute.String("bigquery.job_id", job.ID()))
+	if status == nil || status.Statistics == nil {
+		return
+	}
+	span.SetAttributes(attribute.Int64("bigquery.bytes_processed",
+		status.Statistics.TotalBytesProcessed))
+	if details, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		span.SetAttributes(
+			attribute.Int64("bigquery.bytes_billed",
+				details.TotalBytesBilled),
+			attribute.Bool("bigquery.cache_hit", details.CacheHit),
+		)
+	}
+}
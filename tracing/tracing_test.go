@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type mockJob struct {
+	bqiface.Job
+}
+
+func (j *mockJob) ID() string {
+	return "job-id"
+}
+
+func TestSetJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *bigquery.JobStatus
+		want   []attribute.KeyValue
+	}{
+		{
+			name: "query",
+			status: &bigquery.JobStatus{
+				Statistics: &bigquery.JobStatistics{
+					TotalBytesProcessed: 10,
+					Details: &bigquery.QueryStatistics{
+						TotalBytesBilled: 20,
+						CacheHit:         true,
+					},
+				},
+			},
+			want: []attribute.KeyValue{
+				attribute.String("bigquery.job_id", "job-id"),
+				attribute.Int64("bigquery.bytes_processed", 10),
+				attribute.Int64("bigquery.bytes_billed", 20),
+				attribute.Bool("bigquery.cache_hit", true),
+			},
+		},
+		{
+			name: "no-status",
+			want: []attribute.KeyValue{
+				attribute.String("bigquery.job_id", "job-id"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			_, span := tp.Tracer("test").Start(context.Background(), "test")
+			SetJob(span, &mockJob{}, tt.status)
+			span.End()
+			got := recorder.Ended()[0].Attributes()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SetJob() set %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{
+			name: "error",
+			err:  errors.New("failed"),
+			want: codes.Error,
+		},
+		{
+			name: "success",
+			want: codes.Unset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			_, span := tp.Tracer("test").Start(context.Background(), "test")
+			SetError(span, tt.err)
+			span.End()
+			if got := recorder.Ended()[0].Status().Code; got != tt.want {
+				t.Errorf("SetError() set status %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetup(t *testing.T) {
+	for _, exp := range []string{None, Stdout} {
+		t.Run(exp, func(t *testing.T) {
+			exporterType.Value = exp
+			defer func() { exporterType.Value = None }()
+			shutdown, err := Setup(context.Background(), "test")
+			if err != nil {
+				t.Fatalf("Setup() returned err: %v", err)
+			}
+			if err := shutdown(context.Background()); err != nil {
+				t.Errorf("shutdown() returned err: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryAttributes(t *testing.T) {
+	got := QueryAttributes("global", "SELECT 1")
+	want := []attribute.KeyValue{
+		attribute.String("config", "global"),
+		attribute.String("query.sha256",
+			"e004ebd5b5532a4b85984a62f8ad48a81aa3460c1ca07701f386135d72cdecf5"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryAttributes() = %v, want %v", got, want)
+	}
+}